@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A BuildStep is a single external program run while compiling a
+// .tex file.  The strings in Arguments, Environment and Requires may
+// refer to $FILENAME (the path to the .tex file), $BASENAME (the
+// filename without its directory) and $JOBNAME (the basename without
+// its extension); anything else is taken from the environment.
+type BuildStep struct {
+	Name        string   `json:"name"`
+	Command     string   `json:"command"`
+	Arguments   []string `json:"arguments"`
+	Environment []string `json:"environment"`
+
+	// Requires names a file which must exist for the step to run
+	Requires string `json:"requires"`
+
+	// AllowFailure means a failing step does not stop the compilation
+	AllowFailure bool `json:"allowFailure"`
+
+	// Timeout (e.g., "90s" or "10m") overrides the repository's
+	// timeout for this step
+	Timeout string `json:"timeout"`
+
+	// Converge reruns the step until the .aux file settles down and
+	// TeX stops asking to be rerun
+	Converge bool `json:"converge"`
+
+	// LogFormat is "sage" for steps whose errors should be found in
+	// their output; otherwise errors are read from the TeX .log
+	LogFormat string `json:"logFormat"`
+
+	// CacheKey names a file which determines the results of the
+	// step; when it is set, the files named by CacheOutputs are
+	// saved, and reused the next time the key file is unchanged
+	CacheKey     string   `json:"cacheKey"`
+	CacheOutputs []string `json:"cacheOutputs"`
+}
+
+// A Backend is the sequence of steps which turns a .tex file into an
+// .html file
+type Backend struct {
+	Steps []BuildStep `json:"steps"`
+
+	// Outputs are glob patterns (which may refer to $JOBNAME) naming
+	// the files to keep once the steps have run
+	Outputs []string `json:"outputs"`
+}
+
+const defaultBackendName = "htlatex"
+
+// A converging step is run at most this many times, unless the
+// repository configuration says otherwise
+const defaultMaximumPasses = 5
+
+var rerunRequest = regexp.MustCompile("Rerun to get|Please rerun|Rerun LaTeX|Label\\(s\\) may have changed")
+
+// Steps which take longer than this are presumably waiting on
+// something that will never happen, like a \read from the terminal
+const defaultStepTimeout = 10 * time.Minute
+
+// stepTimeout is set from the --timeout flag
+var stepTimeout time.Duration
+
+var errInterrupted = errors.New("interrupted")
+
+// A TimeoutError reports that a build step was killed because it ran
+// for too long
+type TimeoutError struct {
+	Step    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Step, e.Timeout)
+}
+
+// The quotation marks are passed along to TeX, as they always have been
+var ximeraClassOptions = "\"\\PassOptionsToClass{tikzexport}{ximera}\\PassOptionsToClass{xake}{ximera}\\PassOptionsToClass{xake}{xourse}\\nonstopmode\\input{$BASENAME}\""
+
+var sageStep = BuildStep{
+	Name:      "sage",
+	Command:   "sage",
+	Arguments: []string{"$JOBNAME.sagetex.sage"},
+	// Keep the traceback next to the message announcing it
+	Environment:  []string{"PYTHONUNBUFFERED=1"},
+	Requires:     "$JOBNAME.sagetex.sage",
+	LogFormat:    sageLogFormat,
+	CacheKey:     "$JOBNAME.sagetex.sage",
+	CacheOutputs: []string{"$JOBNAME.sagetex.sout", "$JOBNAME.sagetex.scmd", "sage-plots-for-$JOBNAME.tex"},
+}
+
+var pdflatexStep = BuildStep{
+	Name:      "pdflatex",
+	Command:   "pdflatex",
+	Arguments: []string{"-file-line-error", "-shell-escape", "-recorder", ximeraClassOptions},
+	Converge:  true,
+}
+
+var lualatexStep = BuildStep{
+	Name:      "lualatex",
+	Command:   "lualatex",
+	Arguments: []string{"-file-line-error", "-shell-escape", "-recorder", ximeraClassOptions},
+	Converge:  true,
+}
+
+// After sage runs, TeX must run again to pick up the results
+func afterSage(step BuildStep) BuildStep {
+	step.Requires = sageStep.Requires
+	return step
+}
+
+var builtinBackends = map[string]Backend{
+	// The traditional pipeline: pdflatex, sage, pdflatex, htlatex
+	"htlatex": {
+		Steps: []BuildStep{
+			pdflatexStep,
+			sageStep,
+			afterSage(pdflatexStep),
+			{
+				Name:      "htlatex",
+				Command:   "htlatex",
+				Arguments: []string{"$BASENAME", "ximera,charset=utf-8,-css", " -cunihtf -utf8", "", "--interaction=nonstopmode -shell-escape -file-line-error"},
+			},
+		},
+	},
+
+	// The LuaTeX pipeline: lualatex, sage, lualatex, make4ht
+	"make4ht": {
+		Steps: []BuildStep{
+			lualatexStep,
+			sageStep,
+			afterSage(lualatexStep),
+			{
+				Name:      "make4ht",
+				Command:   "make4ht",
+				Arguments: []string{"-l", "-u", "-s", "$BASENAME", "ximera,charset=utf-8,-css", "", "", "--interaction=nonstopmode -file-line-error"},
+			},
+		},
+	},
+}
+
+// requestedBackend looks in the preamble of filename for a comment
+// of the form "% !xake backend = NAME"
+func requestedBackend(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic, _ := regexp.Compile("^\\s*%\\s*!\\s*xake\\s+backend\\s*=\\s*(\\S+)")
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.Contains(line, "\\begin{document}") {
+			break
+		}
+
+		matches := magic.FindStringSubmatch(line)
+		if len(matches) > 0 {
+			return matches[1], nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// BackendFor chooses the backend for filename, preferring what the
+// file itself requests, then the repository configuration, and then
+// the default htlatex pipeline.
+func BackendFor(filename string) (string, Backend, error) {
+	name := configuration.Backend
+
+	requested, err := requestedBackend(filename)
+	if err == nil && requested != "" {
+		name = requested
+	}
+
+	if name == "" {
+		name = defaultBackendName
+	}
+
+	if backend, ok := configuration.Backends[name]; ok {
+		return name, backend, nil
+	}
+
+	if backend, ok := builtinBackends[name]; ok {
+		return name, backend, nil
+	}
+
+	return name, Backend{}, fmt.Errorf("Unknown backend %s requested for %s", name, filename)
+}
+
+// backendOutputs are the patterns naming the files which the backend
+// produces
+func backendOutputs(backend Backend) []string {
+	if len(backend.Outputs) == 0 {
+		return defaultOutputs
+	}
+	return backend.Outputs
+}
+
+func expandStepString(s string, filename string) string {
+	return os.Expand(s, func(name string) string {
+		switch name {
+		case "FILENAME":
+			return filename
+		case "BASENAME":
+			return filepath.Base(filename)
+		case "JOBNAME":
+			return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		}
+		return os.Getenv(name)
+	})
+}
+
+// isStepApplicable checks that the file named by the step's Requires
+// field (if any) is present
+func isStepApplicable(step BuildStep, filename string) bool {
+	if step.Requires == "" {
+		return true
+	}
+
+	return exists(filepath.Join(filepath.Dir(filename), expandStepString(step.Requires, filename)))
+}
+
+// timeoutForStep prefers the --timeout flag, then the step's own
+// timeout, and then the repository configuration
+func timeoutForStep(step BuildStep) (time.Duration, error) {
+	if stepTimeout > 0 {
+		return stepTimeout, nil
+	}
+
+	if step.Timeout != "" {
+		return time.ParseDuration(step.Timeout)
+	}
+
+	if configuration.Timeout != "" {
+		return time.ParseDuration(configuration.Timeout)
+	}
+
+	return defaultStepTimeout, nil
+}
+
+func maximumPasses() int {
+	if configuration.MaxPasses > 0 {
+		return configuration.MaxPasses
+	}
+	return defaultMaximumPasses
+}
+
+// runConvergingStep runs the step as many times as it takes for
+// cross-references to settle, which is often just once, and reports
+// how long each pass took.  A pass is needed again when the log asks
+// for a rerun, or when the .aux file differs from the one the pass
+// started with.
+func runConvergingStep(ctx context.Context, step BuildStep, filename string) ([]byte, []time.Duration, bool, error) {
+	jobname := strings.TrimSuffix(filename, filepath.Ext(filename))
+	auxFilename := jobname + ".aux"
+	logFilename := jobname + ".log"
+
+	previousHash, previousErr := HashObject(auxFilename)
+
+	var passes []time.Duration
+	for pass := 1; ; pass++ {
+		start := time.Now()
+		output, err := runBuildStep(ctx, step, filename)
+		passes = append(passes, time.Since(start))
+		if err != nil {
+			return output, passes, false, err
+		}
+
+		rerun := false
+
+		logData, err := ioutil.ReadFile(logFilename)
+		if err == nil && rerunRequest.Match(logData) {
+			log.Debug(fmt.Sprintf("%s asked to be rerun after pass %d of %s", filepath.Base(filename), pass, step.Name))
+			rerun = true
+		}
+
+		hash, err := HashObject(auxFilename)
+		if previousErr == nil && err == nil && hash != previousHash {
+			log.Debug(fmt.Sprintf("%s changed during pass %d of %s", filepath.Base(auxFilename), pass, step.Name))
+			rerun = true
+		}
+
+		if !rerun {
+			return output, passes, true, nil
+		}
+
+		if pass >= maximumPasses() {
+			return output, passes, false, nil
+		}
+
+		previousHash, previousErr = hash, err
+	}
+}
+
+// runBuildStep runs the step's command in the directory containing
+// filename; the command, and everything it spawned, is killed if the
+// step times out or the context is cancelled.
+func runBuildStep(ctx context.Context, step BuildStep, filename string) ([]byte, error) {
+	if ctx.Err() != nil {
+		return []byte{}, errInterrupted
+	}
+
+	timeout, err := timeoutForStep(step)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var cmdArgs []string
+	for _, argument := range step.Arguments {
+		cmdArgs = append(cmdArgs, expandStepString(argument, filename))
+	}
+
+	cmd := exec.Command(step.Command, cmdArgs...)
+	cmd.Dir = filepath.Dir(filename)
+
+	if len(step.Environment) > 0 {
+		cmd.Env = os.Environ()
+		for _, variable := range step.Environment {
+			cmd.Env = append(cmd.Env, expandStepString(variable, filename))
+		}
+	}
+
+	var cmdOut bytes.Buffer
+	cmd.Stdout = &cmdOut
+	cmd.Stderr = &cmdOut
+
+	err = runWithTimeout(ctx, cmd, step.Name, timeout)
+
+	// sage can report an error without failing
+	if err == nil && step.LogFormat == sageLogFormat && hasErrors(ParseSageOutput(filename, cmdOut.Bytes())) {
+		err = fmt.Errorf("%s reported an error", step.Name)
+	}
+	return cmdOut.Bytes(), err
+}
+
+// runWithTimeout runs cmd in a process group of its own, killing it
+// and everything it spawned if it takes longer than timeout (returning
+// a TimeoutError for the step called name) or the context is cancelled
+// (returning errInterrupted).  Killing only the command would leave
+// its children holding its output open, so waiting would never end.
+func runWithTimeout(ctx context.Context, cmd *exec.Cmd, name string, timeout time.Duration) error {
+	err := startInProcessGroup(cmd)
+	if err != nil {
+		return err
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.Wait()
+	}()
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case err := <-finished:
+		return err
+
+	case <-stepCtx.Done():
+		killProcessGroup(cmd)
+		<-finished
+
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return &TimeoutError{Step: name, Timeout: timeout}
+	}
+}
@@ -1,35 +1,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/cheggaaa/pb.v1"
 	"os"
 	"sync"
+	"text/tabwriter"
+	"time"
 )
 
-func Bake(workers int) error {
+// A SkippedError explains why a file was never compiled
+type SkippedError struct {
+	Filename string
+	// Dependency is the file which failed (or was itself skipped);
+	// without one, the file was skipped because the build stopped
+	Dependency string
+	// Interrupted is set when the build stopped because it was
+	// interrupted, rather than after an error
+	Interrupted bool
+}
+
+func (e *SkippedError) Error() string {
+	if e.Interrupted {
+		return "not compiled because the build was interrupted"
+	}
+	if e.Dependency == "" {
+		return "not compiled because the build stopped after an error"
+	}
+	return "not compiled because it depends on " + displayName(e.Dependency) + ", which was not compiled"
+}
+
+type compileResult struct {
+	filename string
+	err      error
+}
+
+// CompileInOrder compiles files using a pool of workers, never
+// starting a file before the files it depends on have finished.
+// After each file, finish is called (by one worker at a time) with a
+// report on compiling it.  Files which depend on a file that failed
+// are not compiled, and are finished with a SkippedError; unless
+// keepGoing, the first failure stops any more files from starting,
+// though those already started are allowed to finish.  Once ctx is
+// cancelled, no more files start, whether or not keepGoing, and
+// those which were not compiled are finished with a SkippedError.
+func CompileInOrder(ctx context.Context, workers int, directory string, files []string, dependencies map[string][]string, keepGoing bool, finish func(FileReport, error)) {
 	tasks := make(chan string)
 	queue := make(chan string)
 
 	log.Debug(fmt.Sprintf("Using %d workers", workers))
 
-	files, dependencies, err := NeedingCompilation(repository)
-	// BADBAD: need to display error from compilation if it fails
-	if err != nil {
-		return err
-	}
-
-	finished := make(chan string, len(files))
-	finishedCount := 0
-
-	var bar *pb.ProgressBar
-	if log.Level != logrus.DebugLevel {
-		bar = pb.StartNew(len(files))
-		//bar.SetMaxWidth(80)
-		bar.ShowTimeLeft = true
-		bar.Start()
-	}
+	finished := make(chan compileResult, len(files))
+	var finishMutex sync.Mutex
+	stopped := false
 
 	// Manage a pool of workers
 	var group sync.WaitGroup
@@ -38,24 +63,37 @@ func Bake(workers int) error {
 		go func(workerId int) {
 			log.Debug(fmt.Sprintf("Worker %d is running", workerId))
 			for task := range tasks {
-				log.Debug(fmt.Sprintf("Worker %d is compiling %s", workerId, task))
-				_, err := Compile(repository, task)
+				finishMutex.Lock()
+				stopping := stopped
+				finishMutex.Unlock()
 
-				if err != nil {
-					log.Error("Could not compile " + task)
-					os.Exit(1)
+				var err error
+				var report FileReport
+				start := time.Now()
+				if ctx.Err() != nil {
+					log.Debug(fmt.Sprintf("Worker %d skips %s since the build was interrupted", workerId, task))
+					err = &SkippedError{Filename: task, Interrupted: true}
+				} else if stopping {
+					log.Debug(fmt.Sprintf("Worker %d skips %s since the build has stopped", workerId, task))
+					err = &SkippedError{Filename: task}
 				} else {
-					log.Debug(fmt.Sprintf("Worker %d finishes with %s", workerId, task))
-
-					finished <- task
-					finishedCount++
-
-					if log.Level != logrus.DebugLevel {
-						bar.Increment()
-					} else {
-						log.Info(fmt.Sprintf("Finished %d/%d tasks", finishedCount, len(files)))
+					log.Debug(fmt.Sprintf("Worker %d is compiling %s", workerId, task))
+					_, err = CompileWithReport(ctx, directory, task, &report)
+					if err == errInterrupted {
+						err = &SkippedError{Filename: task, Interrupted: true}
 					}
 				}
+				report.finish(task, start, err)
+
+				finishMutex.Lock()
+				if err != nil && !keepGoing {
+					stopped = true
+				}
+				finish(report, err)
+				finishMutex.Unlock()
+
+				log.Debug(fmt.Sprintf("Worker %d finishes with %s", workerId, task))
+				finished <- compileResult{filename: task, err: err}
 			}
 			group.Done()
 		}(i + 1)
@@ -70,53 +108,219 @@ func Bake(workers int) error {
 		close(tasks)
 	}()
 
+	skip := func(file string, err *SkippedError) {
+		var report FileReport
+		report.finish(file, time.Now(), err)
+		finish(report, err)
+	}
+
 	compiled := make(map[string]bool)
-	enqueued := make(map[string]bool)
-	enqueuedCount := 0
+	failed := make(map[string]bool)
+	done := make(map[string]bool)
+	running := 0
 
 	for {
-		// add everything that can be compiled given what has been completed
-		for _, file := range files {
-			if enqueued[file] {
-				continue
-			}
+		finishMutex.Lock()
+		stopping := stopped || ctx.Err() != nil
+		finishMutex.Unlock()
+
+		// add everything that can be compiled given what has been
+		// completed, skipping whatever depends on a failure; since
+		// skipping one file may doom another, go until nothing changes
+		for progress := !stopping; progress; {
+			progress = false
 
-			good := true
-			for _, dependency := range dependencies[file] {
-				if !compiled[dependency] {
-					good = false
-					break
+			for _, file := range files {
+				if done[file] {
+					continue
 				}
-			}
 
-			if good {
-				log.Debug("Placing " + file + " into the queue")
-				queue <- file
-				enqueued[file] = true
-				enqueuedCount++
+				good := true
+				for _, dependency := range dependencies[file] {
+					if failed[dependency] {
+						log.Debug("Skipping " + file + " because " + dependency + " was not compiled")
+						done[file] = true
+						failed[file] = true
+						progress = true
+
+						finishMutex.Lock()
+						skip(file, &SkippedError{Filename: file, Dependency: dependency})
+						finishMutex.Unlock()
+
+						good = false
+						break
+					}
+
+					if !compiled[dependency] {
+						good = false
+						break
+					}
+				}
+
+				if good {
+					log.Debug("Placing " + file + " into the queue")
+					queue <- file
+					done[file] = true
+					running++
+				}
 			}
 		}
 
-		log.Debug(fmt.Sprintf("%d tasks have been placed in the queue.", enqueuedCount))
-		if enqueuedCount >= len(files) {
-			log.Debug("Everything is in the queue.")
+		if running == 0 {
+			log.Debug("Nothing more can be placed in the queue.")
 			break
 		}
 
 		log.Debug("Wait for things to finish before placing more into the queue.")
 		// get more finished things
-		compiled[<-finished] = true
+		result := <-finished
+		running--
+		if result.err != nil {
+			failed[result.filename] = true
+		} else {
+			compiled[result.filename] = true
+		}
 	}
 
 	close(queue)
 	log.Debug("Waiting for the workers to finish.")
 	group.Wait()
 
+	// whatever was never started was stopped by a failure, or by an
+	// interruption
+	for _, file := range files {
+		if !done[file] {
+			skip(file, &SkippedError{Filename: file, Interrupted: ctx.Err() != nil})
+		}
+	}
+
+	FlushBuildStates()
+}
+
+// DryRunBake describes what Bake would compile, and why, without
+// compiling anything
+func DryRunBake(asJson bool) error {
+	filenames, err := TexFilesInRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	plan, err := PlanCompilation(filenames)
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		return DisplayBuildPlanJson(repository, plan)
+	}
+
+	DisplayBuildPlan(repository, plan)
+	return nil
+}
+
+// DisplayBakeSummary prints a table of the files which failed, were
+// skipped, and were compiled, along with the first diagnostic of each
+// failure; files which an interruption kept from compiling are only
+// counted
+func DisplayBakeSummary(reports []FileReport) {
+	var failed, skipped, succeeded []FileReport
+	interrupted := 0
+	for _, report := range reports {
+		switch report.Status {
+		case skippedStatus:
+			skipped = append(skipped, report)
+		case failedStatus:
+			failed = append(failed, report)
+		case interruptedStatus:
+			interrupted++
+		default:
+			succeeded = append(succeeded, report)
+		}
+	}
+
+	fmt.Printf("\n%d compiled, %d failed, %d skipped", len(succeeded), len(failed), len(skipped))
+	if interrupted > 0 {
+		fmt.Printf(", %d not compiled because the build was interrupted", interrupted)
+	}
+	fmt.Printf("\n\n")
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, report := range failed {
+		fmt.Fprintf(table, "failed\t%s\t%s\n", displayName(report.Filename), firstDiagnostic(report))
+	}
+	for _, report := range skipped {
+		fmt.Fprintf(table, "skipped\t%s\t%s\n", displayName(report.Filename), report.Error)
+	}
+	for _, report := range succeeded {
+		fmt.Fprintf(table, "compiled\t%s\t\n", displayName(report.Filename))
+	}
+	table.Flush()
+}
+
+// Bake compiles everything in the repository which needs it, and
+// reports on each file.  Unless keepGoing, it stops starting new files
+// after the first failure.
+func Bake(ctx context.Context, workers int, keepGoing bool) ([]FileReport, error) {
+	var reports []FileReport
+
+	files, dependencies, err := NeedingCompilation(repository)
+	// BADBAD: need to display error from compilation if it fails
+	if err != nil {
+		return reports, err
+	}
+
+	finishedCount := 0
+	failures := 0
+
+	var bar *pb.ProgressBar
+	if log.Level != logrus.DebugLevel {
+		bar = pb.StartNew(len(files))
+		//bar.SetMaxWidth(80)
+		bar.ShowTimeLeft = true
+		bar.Start()
+	}
+
+	CompileInOrder(ctx, workers, repository, files, dependencies, keepGoing, func(report FileReport, err error) {
+		reports = append(reports, report)
+
+		if report.Status == failedStatus {
+			failures++
+			DisplayCompileError(err)
+			log.Error("Could not compile " + report.Filename)
+		}
+
+		finishedCount++
+
+		if log.Level != logrus.DebugLevel {
+			bar.Increment()
+		} else {
+			log.Info(fmt.Sprintf("Finished %d/%d tasks", finishedCount, len(files)))
+		}
+	})
+
+	if failures > 0 {
+		if log.Level != logrus.DebugLevel {
+			bar.Finish()
+		}
+		DisplayBakeSummary(reports)
+		if failures == 1 {
+			return reports, fmt.Errorf("1 file could not be compiled")
+		}
+		return reports, fmt.Errorf("%d files could not be compiled", failures)
+	}
+
+	if ctx.Err() != nil {
+		if log.Level != logrus.DebugLevel {
+			bar.Finish()
+		}
+		return reports, fmt.Errorf("the build was interrupted")
+	}
+
 	if log.Level != logrus.DebugLevel {
 		bar.FinishPrint("The xake is made.")
 	} else {
 		log.Info("The xake is made.")
 	}
 
-	return nil
+	return reports, nil
 }
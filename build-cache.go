@@ -0,0 +1,475 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bump this whenever the contents of a cached build change meaning
+const buildCacheVersion = 4
+
+// useBuildCache is cleared by the --no-cache flag
+var useBuildCache = true
+
+func buildCacheDirectory() (string, error) {
+	directory, err := cacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, "builds"), nil
+}
+
+func buildCachePath(key string) (string, error) {
+	directory, err := buildCacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, key[0:2], key+".tar.gz"), nil
+}
+
+// BuildCacheKey hashes everything which determines the outputs of
+// compiling filename: its path in the repository, since the cached
+// .html names its dependencies and links to activities relative to the
+// repository; its inputs, named relative to filename; the backend, the
+// HTML transforms, and the toolchain.  Nothing depends on where the
+// repository is checked out, or on what was compiled there before:
+// the inputs are the files which scanning the sources finds filename
+// depends on, but not every file beside it, so that editing one
+// activity does not invalidate the rest of its chapter.
+func BuildCacheKey(directory string, filename string, backendName string, backend Backend) (string, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+
+	directory, err = filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(directory, filename)
+	if err != nil {
+		return "", err
+	}
+
+	hashes := make(map[string]string)
+	var names []string
+
+	inputs, err := compiledDependencies(filename, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, input := range inputs {
+		name, err := filepath.Rel(filepath.Dir(filename), input)
+		if err != nil {
+			return "", err
+		}
+
+		hash, err := HashObject(input)
+		if err != nil {
+			return "", err
+		}
+
+		hashes[name] = hash
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	description, err := json.Marshal(backend)
+	if err != nil {
+		return "", err
+	}
+
+	transforms, err := json.Marshal(transformChain())
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "xake build cache %d\n", buildCacheVersion)
+	fmt.Fprintf(h, "file %s\n", filepath.ToSlash(relative))
+	fmt.Fprintf(h, "backend %s %s\n", backendName, description)
+	fmt.Fprintf(h, "transforms %s\n", transforms)
+	for _, transform := range transformChain() {
+		// filters kept in the repository are inputs, too
+		if transform.Command != "" {
+			hash, err := HashObject(filepath.Join(directory, transform.Command))
+			if err == nil {
+				fmt.Fprintf(h, "filter %s %s\n", hash, transform.Command)
+			}
+		}
+	}
+	fmt.Fprintf(h, "toolchain %s\n", ToolchainFingerprint(backend))
+	for _, name := range names {
+		fmt.Fprintf(h, "input %s %s\n", hashes[name], filepath.ToSlash(name))
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// writeArchive bundles the given files, named relative to directory,
+// into a gzipped tarball
+func writeArchive(w io.Writer, directory string, filenames []string) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	for _, filename := range filenames {
+		name, err := filepath.Rel(directory, filename)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(archive, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// isRestorableOutput decides whether name, relative to the directory
+// of filename and with forward slashes, could be an output of
+// compiling filename: it must match one of the backend's output
+// patterns and be named after the job, so that a cached build can
+// never replace a source or the build state
+func isRestorableOutput(name string, filename string, patterns []string) bool {
+	if path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "..") {
+		return false
+	}
+
+	jobname := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if path.Base(name) == filepath.Base(filename) || !isNamedForJob(path.Base(name), jobname) {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(filepath.ToSlash(expandStepString(pattern, filename)), name)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractArchive unpacks a tarball made by writeArchive for filename
+// next to it, and returns the paths of the files it wrote; it refuses
+// links, and anything which is not one of the outputs named by
+// patterns
+func extractArchive(r io.Reader, filename string, patterns []string) ([]string, error) {
+	var filenames []string
+
+	directory := filepath.Dir(filename)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return filenames, err
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return filenames, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return filenames, errors.New("Refusing to extract " + header.Name + ", which is not a regular file, from a cached build")
+		}
+
+		if !isRestorableOutput(header.Name, filename, patterns) {
+			return filenames, errors.New("Refusing to extract " + header.Name + ", which is not an output of " + filepath.Base(filename) + ", from a cached build")
+		}
+
+		output := filepath.Join(directory, filepath.FromSlash(header.Name))
+		err = os.MkdirAll(filepath.Dir(output), 0755)
+		if err != nil {
+			return filenames, err
+		}
+
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode)&os.ModePerm)
+		if err != nil {
+			return filenames, err
+		}
+		_, err = io.Copy(f, archive)
+		f.Close()
+		if err != nil {
+			return filenames, err
+		}
+
+		filenames = append(filenames, output)
+	}
+
+	return filenames, nil
+}
+
+// RestoreFromBuildCache copies the outputs (matching patterns) of a
+// previous build with the same key next to filename, and reports
+// whether there was one; builds missing locally are sought in the
+// remote cache, if any.
+func RestoreFromBuildCache(key string, filename string, patterns []string) bool {
+	path, err := buildCachePath(key)
+	if err != nil {
+		return false
+	}
+
+	if !exists(path) && !fetchFromRemoteCache(key, path) {
+		return false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = extractArchive(f, filename, patterns)
+	if err != nil {
+		log.Warn("Could not restore " + filename + " from the cache: " + err.Error())
+		return false
+	}
+
+	// the modification time records when an entry was last useful
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return true
+}
+
+// StoreInBuildCache saves the outputs of compiling filename, and
+// shares them with the remote cache, if any; builds with outputs which
+// could not be restored (see isRestorableOutput) are not saved
+func StoreInBuildCache(key string, filename string, outputs []string, patterns []string) error {
+	for _, output := range outputs {
+		name, err := filepath.Rel(filepath.Dir(filename), output)
+		if err != nil || !isRestorableOutput(filepath.ToSlash(name), filename, patterns) {
+			log.Debug("Not caching " + filename + " since " + output + " is not named after it")
+			return nil
+		}
+	}
+
+	path, err := buildCachePath(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = writeArchive(f, filepath.Dir(filename), outputs)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	uploadToRemoteCache(key, path)
+	return nil
+}
+
+type buildCacheEntry struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func listBuildCache() ([]buildCacheEntry, error) {
+	var entries []buildCacheEntry
+
+	directory, err := buildCacheDirectory()
+	if err != nil {
+		return entries, err
+	}
+
+	if !exists(directory) {
+		return entries, nil
+	}
+
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".tar.gz") {
+			entries = append(entries, buildCacheEntry{path: path, size: info.Size(), used: info.ModTime()})
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value = value / 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// parseSize understands sizes like 500M or 2G
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			multiplier = int64(1) << (10 * uint(i+1))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(value * float64(multiplier)), nil
+}
+
+// DisplayBuildCacheStatistics describes what is in the build cache
+func DisplayBuildCacheStatistics() error {
+	directory, err := buildCacheDirectory()
+	if err != nil {
+		return err
+	}
+
+	entries, err := listBuildCache()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var oldest, newest time.Time
+	for i, entry := range entries {
+		total += entry.size
+		if i == 0 || entry.used.Before(oldest) {
+			oldest = entry.used
+		}
+		if i == 0 || entry.used.After(newest) {
+			newest = entry.used
+		}
+	}
+
+	fmt.Printf("Cache directory: %s\n", directory)
+	fmt.Printf("Cached builds:   %d\n", len(entries))
+	fmt.Printf("Total size:      %s\n", formatSize(total))
+	if len(entries) > 0 {
+		fmt.Printf("Least recent:    %s\n", oldest.Format(time.RFC1123))
+		fmt.Printf("Most recent:     %s\n", newest.Format(time.RFC1123))
+	}
+
+	return nil
+}
+
+// PruneBuildCache removes the builds which have not been used within
+// maximumAge, and then the least recently used builds until the cache
+// fits in maximumSize (when maximumSize is positive)
+func PruneBuildCache(maximumAge time.Duration, maximumSize int64) error {
+	entries, err := listBuildCache()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.After(entries[j].used)
+	})
+
+	var kept int64
+	var removed int
+	var freed int64
+	cutoff := time.Now().Add(-maximumAge)
+
+	for _, entry := range entries {
+		tooOld := maximumAge > 0 && entry.used.Before(cutoff)
+		tooBig := maximumSize > 0 && kept+entry.size > maximumSize
+
+		if tooOld || tooBig {
+			err := os.Remove(entry.path)
+			if err != nil {
+				return err
+			}
+			removed++
+			freed += entry.size
+		} else {
+			kept += entry.size
+		}
+	}
+
+	fmt.Printf("Removed %d cached builds, freeing %s.\n", removed, formatSize(freed))
+
+	return nil
+}
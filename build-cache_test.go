@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkout writes the same small repository into a new directory
+func checkout(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, directory, map[string]string{
+		"chapter/intro.tex":    "\\documentclass{ximera}\n\\input{../preamble}\n\\begin{document}\n\\includegraphics{graph}\n\\end{document}\n",
+		"chapter/graph.png":    "png",
+		"chapter/sibling.tex":  "\\documentclass{ximera}\n",
+		"chapter/notes.txt":    "notes",
+		"preamble.tex":         "\\usepackage{macros}\n",
+		"macros.sty":           "\\newcommand{\\x}{x}\n",
+		"chapter/recorded.tex": "read through a macro\n",
+	})
+
+	return directory
+}
+
+func TestBuildCacheKeyIsTheSameInEveryCheckout(t *testing.T) {
+	first := checkout(t)
+	defer os.RemoveAll(first)
+	second := checkout(t)
+	defer os.RemoveAll(second)
+
+	_, backend, err := BackendFor(filepath.Join(first, "chapter", "intro.tex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(directory string) string {
+		key, err := BuildCacheKey(directory, filepath.Join(directory, "chapter", "intro.tex"), "pdflatex", backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	original := key(first)
+	if key(second) != original {
+		t.Errorf("two checkouts of the same sources have different keys")
+	}
+
+	// a previous build in one checkout does not change its key
+	err = RecordBuildState(first, filepath.Join(first, "chapter", "intro.tex"), TargetState{
+		Outcome: compiledOutcome,
+		Inputs:  map[string]InputState{"chapter/recorded.tex": {Hash: "0123"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	FlushBuildStates()
+	if key(first) != original {
+		t.Errorf("recording a build changed the key")
+	}
+
+	writeFiles(t, second, map[string]string{"chapter/sibling.tex": "\\documentclass{ximera}\n% edited\n"})
+	if key(second) != original {
+		t.Errorf("editing a file beside the target changed its key")
+	}
+
+	writeFiles(t, second, map[string]string{"macros.sty": "\\newcommand{\\x}{y}\n"})
+	if key(second) == original {
+		t.Errorf("editing a package the target uses did not change its key")
+	}
+}
+
+func TestIsRestorableOutput(t *testing.T) {
+	tests := []struct {
+		name       string
+		restorable bool
+	}{
+		{"intro.html", true},
+		{"intro-figure1.svg", true},
+		{"intro0x.png", true},
+		{"intro.tex", false},
+		{"introduction.html", false},
+		{"other.html", false},
+		{"intro.css", false},
+		{"../intro.html", false},
+		{"/tmp/intro.html", false},
+		{"sub/../intro.html", false},
+		{".xake/state", false},
+	}
+
+	for _, test := range tests {
+		restorable := isRestorableOutput(test.name, "/repository/chapter/intro.tex", defaultOutputs)
+		if restorable != test.restorable {
+			t.Errorf("isRestorableOutput(%q) = %v, expected %v", test.name, restorable, test.restorable)
+		}
+	}
+}
+
+func TestExtractArchiveRefusesPoisonedBuilds(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	filename := filepath.Join(directory, "intro.tex")
+	writeFiles(t, directory, map[string]string{"intro.tex": "source"})
+
+	archive := func(headers ...*tar.Header) *bytes.Buffer {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		w := tar.NewWriter(gz)
+		for _, header := range headers {
+			if header.Typeflag == tar.TypeReg {
+				header.Size = int64(len("poison"))
+			}
+			header.Mode = 0644
+			if err := w.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Typeflag == tar.TypeReg {
+				w.Write([]byte("poison"))
+			}
+		}
+		w.Close()
+		gz.Close()
+		return &b
+	}
+
+	tests := []struct {
+		name   string
+		header *tar.Header
+	}{
+		{"source", &tar.Header{Name: "intro.tex", Typeflag: tar.TypeReg}},
+		{"build state", &tar.Header{Name: ".xake/state", Typeflag: tar.TypeReg}},
+		{"parent directory", &tar.Header{Name: "../intro.html", Typeflag: tar.TypeReg}},
+		{"symbolic link", &tar.Header{Name: "intro.html", Typeflag: tar.TypeSymlink, Linkname: "intro.tex"}},
+		{"hard link", &tar.Header{Name: "intro.html", Typeflag: tar.TypeLink, Linkname: "intro.tex"}},
+	}
+
+	for _, test := range tests {
+		_, err := extractArchive(archive(test.header), filename, defaultOutputs)
+		if err == nil {
+			t.Errorf("%s: extractArchive accepted %s", test.name, test.header.Name)
+		}
+	}
+
+	source, _ := ioutil.ReadFile(filename)
+	if string(source) != "source" {
+		t.Errorf("a cached build replaced the source")
+	}
+
+	filenames, err := extractArchive(archive(&tar.Header{Name: "intro.html", Typeflag: tar.TypeReg}), filename, defaultOutputs)
+	if err != nil || len(filenames) != 1 {
+		t.Errorf("extractArchive refused an ordinary build: %v", err)
+	}
+}
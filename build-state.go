@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The build state lives inside the repository, next to the files it
+// describes, but is not meant to be committed
+const (
+	stateDirectory = ".xake"
+	stateFilename  = "state"
+	stateVersion   = 2
+)
+
+// Outcomes of compiling a target
+const (
+	compiledOutcome = "compiled"
+	restoredOutcome = "restored"
+	failedOutcome   = "failed"
+)
+
+// An InputState records a file as it was when a target was compiled;
+// the size and modification time let us avoid rehashing files which
+// have not been touched
+type InputState struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+// A TargetState records the last compilation of a .tex file
+type TargetState struct {
+	Backend   string                `json:"backend"`
+	Toolchain map[string]string     `json:"toolchain"`
+	Outcome   string                `json:"outcome"`
+	Error     string                `json:"error,omitempty"`
+	Time      time.Time             `json:"time"`
+	Inputs    map[string]InputState `json:"inputs"`
+	// Output records the .html file we produced, so we notice when
+	// something else (e.g., git checkout) replaces it
+	Output InputState `json:"output"`
+}
+
+// A BuildState maps .tex files, relative to the repository, to their
+// most recent compilation
+type BuildState struct {
+	Version int                     `json:"version"`
+	Targets map[string]*TargetState `json:"targets"`
+}
+
+// While xake runs, the state of each repository is kept in memory;
+// what workers record is written out at most this often, and once
+// more when the workers are done
+const buildStateFlushInterval = 10 * time.Second
+
+// Another xake holding the lock for longer than this has surely died
+const (
+	buildStateLockFilename = "state.lock"
+	buildStateLockTimeout  = 30 * time.Second
+)
+
+// A buildStateStore is the state of one repository, along with the
+// targets recorded since it was last written out
+type buildStateStore struct {
+	directory string
+	state     *BuildState
+	recorded  map[string]*TargetState
+	flushed   time.Time
+}
+
+// buildStateMutex guards the stores, which workers share
+var buildStateMutex sync.Mutex
+var buildStateStores = make(map[string]*buildStateStore)
+
+func buildStatePath(directory string) string {
+	return filepath.Join(directory, stateDirectory, stateFilename)
+}
+
+// LoadBuildState reads the state of the repository's last builds; a
+// missing or unreadable state is simply empty, so that we fall back on
+// the metadata in the .html files
+func LoadBuildState(directory string) *BuildState {
+	state := &BuildState{Version: stateVersion, Targets: make(map[string]*TargetState)}
+
+	data, err := ioutil.ReadFile(buildStatePath(directory))
+	if err != nil {
+		return state
+	}
+
+	var saved BuildState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Warn("Ignoring " + buildStatePath(directory) + ": " + err.Error())
+		return state
+	}
+
+	if saved.Version != stateVersion || saved.Targets == nil {
+		log.Debug("Ignoring " + buildStatePath(directory) + " from another version of xake")
+		return state
+	}
+
+	return &saved
+}
+
+// ensureStateDirectory creates the .xake directory, which git is told
+// to ignore, so authors need do nothing to keep it out of commits
+func ensureStateDirectory(directory string) error {
+	err := os.MkdirAll(filepath.Join(directory, stateDirectory), 0755)
+	if err != nil {
+		return err
+	}
+
+	gitignore := filepath.Join(directory, stateDirectory, ".gitignore")
+	if !exists(gitignore) {
+		return ioutil.WriteFile(gitignore, []byte("*\n"), 0644)
+	}
+
+	return nil
+}
+
+// save writes the state atomically, so that a reader never sees half
+// of it
+func (state *BuildState) save(directory string) error {
+	path := buildStatePath(directory)
+
+	err := ensureStateDirectory(directory)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// buildStateFor returns the store for directory, reading its state
+// the first time; the caller holds buildStateMutex
+func buildStateFor(directory string) *buildStateStore {
+	if absolute, err := filepath.Abs(directory); err == nil {
+		directory = absolute
+	}
+
+	store, ok := buildStateStores[directory]
+	if !ok {
+		store = &buildStateStore{
+			directory: directory,
+			state:     LoadBuildState(directory),
+			recorded:  make(map[string]*TargetState),
+			flushed:   time.Now(),
+		}
+		buildStateStores[directory] = store
+	}
+
+	return store
+}
+
+// CurrentBuildState is a snapshot of the state of the repository at
+// directory, including what has been recorded but not yet written out
+func CurrentBuildState(directory string) *BuildState {
+	buildStateMutex.Lock()
+	defer buildStateMutex.Unlock()
+
+	store := buildStateFor(directory)
+
+	// targets are replaced, never modified, so copying the map is enough
+	state := &BuildState{Version: stateVersion, Targets: make(map[string]*TargetState)}
+	for name, target := range store.state.Targets {
+		state.Targets[name] = target
+	}
+
+	return state
+}
+
+// lockBuildState keeps other copies of xake from writing the state of
+// the repository at directory until unlock is called
+func lockBuildState(directory string) (unlock func(), err error) {
+	err = ensureStateDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(directory, stateDirectory, buildStateLockFilename)
+	start := time.Now()
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			held, _ := f.Stat()
+			f.Close()
+			return func() { removeLockIfHeld(path, held) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		err = breakStaleLock(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if time.Since(start) > buildStateLockTimeout {
+			return nil, fmt.Errorf("%s is locked by another xake", buildStatePath(directory))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// breakStaleLock removes the lock at path if whoever took it has
+// surely died.  Deciding and removing happen while holding a second
+// lock, so that two copies of xake which both find the lock stale
+// cannot each remove it, one of them removing the lock the other just
+// took.  Whether or not it removes anything, the caller must still
+// take the lock itself.
+func breakStaleLock(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) <= buildStateLockTimeout {
+		return nil
+	}
+
+	breaker := path + ".break"
+	f, err := os.OpenFile(breaker, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// breaking a lock takes moments, so an old breaker has died
+		if info, err := os.Stat(breaker); err == nil && time.Since(info.ModTime()) > buildStateLockTimeout {
+			os.Remove(breaker)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(breaker)
+
+	// the lock may have been broken and taken again meanwhile
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(info, current) || time.Since(current.ModTime()) <= buildStateLockTimeout {
+		return nil
+	}
+
+	log.Warn("Removing the stale lock " + path)
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeLockIfHeld removes the lock at path, unless it was broken as
+// stale and someone else now holds it
+func removeLockIfHeld(path string, held os.FileInfo) {
+	current, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	if held != nil && !os.SameFile(held, current) {
+		log.Warn("Another xake took the lock " + path + " while we held it")
+		return
+	}
+
+	os.Remove(path)
+}
+
+// flush writes out the targets recorded since the last flush; the
+// state on disk is reread under the lock, so that targets recorded by
+// another xake meanwhile are kept.  The caller holds buildStateMutex.
+func (store *buildStateStore) flush() error {
+	if len(store.recorded) == 0 {
+		return nil
+	}
+
+	unlock, err := lockBuildState(store.directory)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := LoadBuildState(store.directory)
+	for name, target := range store.recorded {
+		state.Targets[name] = target
+	}
+
+	err = state.save(store.directory)
+	if err != nil {
+		return err
+	}
+
+	store.state = state
+	store.recorded = make(map[string]*TargetState)
+	store.flushed = time.Now()
+	return nil
+}
+
+// RecordBuildState saves the outcome of compiling filename in memory,
+// writing the state out if it has not been written for a while
+func RecordBuildState(directory string, filename string, target TargetState) error {
+	relative, err := filepath.Rel(directory, filename)
+	if err != nil {
+		return err
+	}
+	relative = filepath.ToSlash(relative)
+
+	buildStateMutex.Lock()
+	defer buildStateMutex.Unlock()
+
+	store := buildStateFor(directory)
+	store.state.Targets[relative] = &target
+	store.recorded[relative] = &target
+
+	if time.Since(store.flushed) < buildStateFlushInterval {
+		return nil
+	}
+	return store.flush()
+}
+
+// RecordedBuildInputs is RecordedInputs from the current state of the
+// repository at directory, without copying the whole state
+func RecordedBuildInputs(directory string, inputFilename string) []string {
+	buildStateMutex.Lock()
+	defer buildStateMutex.Unlock()
+
+	store := buildStateFor(directory)
+	return store.state.RecordedInputs(store.directory, inputFilename)
+}
+
+// FlushBuildStates writes out whatever has been recorded but not yet
+// written, in every repository
+func FlushBuildStates() {
+	buildStateMutex.Lock()
+	defer buildStateMutex.Unlock()
+
+	for _, store := range buildStateStores {
+		err := store.flush()
+		if err != nil {
+			log.Warn("Could not save the build state: " + err.Error())
+		}
+	}
+}
+
+// recordCompilation saves the outcome of compiling filename; inputs
+// were recorded before compiling began, so that edits made meanwhile
+// are noticed next time
+func recordCompilation(directory string, filename string, backendName string, backend Backend, inputs map[string]InputState, recorded []string, outcome string, compileErr error) {
+	target := TargetState{
+		Backend:   backendName,
+		Toolchain: ToolchainComponents(backend),
+		Outcome:   outcome,
+		Time:      time.Now(),
+		Inputs:    inputs,
+	}
+
+	if compileErr != nil {
+		target.Outcome = failedOutcome
+		target.Error = compileErr.Error()
+	} else {
+		for name, input := range SnapshotInputs(directory, recorded) {
+			if _, ok := target.Inputs[name]; !ok {
+				target.Inputs[name] = input
+			}
+		}
+
+		htmlFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+		target.Output, _ = snapshotInput(htmlFilename)
+	}
+
+	err := RecordBuildState(directory, filename, target)
+	if err != nil {
+		log.Warn("Could not record the build state of " + filename + ": " + err.Error())
+	}
+}
+
+// statInput records the size and modification time of filename, but
+// not yet its hash
+func statInput(filename string) (InputState, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return InputState{}, err
+	}
+
+	return InputState{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// snapshotInput records filename as it is now
+func snapshotInput(filename string) (InputState, error) {
+	input, err := statInput(filename)
+	if err != nil {
+		return input, err
+	}
+
+	input.Hash, err = hashFile(filename)
+	return input, err
+}
+
+// SnapshotInputs records the given files, keyed by their names
+// relative to directory; files which cannot be read are left out
+func SnapshotInputs(directory string, filenames []string) map[string]InputState {
+	inputs := make(map[string]InputState)
+
+	for _, filename := range filenames {
+		relative, err := filepath.Rel(directory, filename)
+		if err != nil {
+			continue
+		}
+		relative = filepath.ToSlash(relative)
+
+		if _, ok := inputs[relative]; ok {
+			continue
+		}
+
+		input, err := snapshotInput(filename)
+		if err == nil {
+			inputs[relative] = input
+		}
+	}
+
+	return inputs
+}
+
+// unchanged reports whether the file looks as it did when recorded,
+// hashing it only if its size or modification time differ; hash is
+// the current hash, if it was computed
+func (recorded InputState) unchanged(filename string) (same bool, hash string, err error) {
+	current, err := statInput(filename)
+	if err != nil {
+		return false, "", err
+	}
+
+	if current.Size == recorded.Size && current.ModTime.Equal(recorded.ModTime) {
+		return true, recorded.Hash, nil
+	}
+
+	hash, err = hashFile(filename)
+	if err != nil {
+		return false, "", err
+	}
+
+	return hash == recorded.Hash, hash, nil
+}
+
+// Changes explains why the target built from inputFilename is out of
+// date according to the build state; known is false when the state
+// cannot tell, and the .html metadata should be consulted instead
+func (state *BuildState) Changes(directory string, inputFilename string, outputFilename string) (changes []string, known bool) {
+	relative, err := filepath.Rel(directory, inputFilename)
+	if err != nil {
+		return nil, false
+	}
+
+	target, ok := state.Targets[filepath.ToSlash(relative)]
+	if !ok {
+		return nil, false
+	}
+
+	if target.Outcome == failedOutcome {
+		return []string{"the last compilation failed"}, true
+	}
+
+	current, err := statInput(outputFilename)
+	if err != nil {
+		return []string{filepath.Base(outputFilename) + " is missing"}, true
+	}
+
+	// the .html is not the one we produced, so its own metadata is
+	// better evidence than our state
+	if current.Size != target.Output.Size || !current.ModTime.Equal(target.Output.ModTime) {
+		return nil, false
+	}
+
+	changes = append(changes, ToolchainChanges(inputFilename, target.Backend, target.Toolchain)...)
+
+	var names []string
+	for name := range target.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		recorded := target.Inputs[name]
+		same, hash, err := recorded.unchanged(filepath.Join(directory, filepath.FromSlash(name)))
+		if err != nil {
+			changes = append(changes, name+" was removed")
+		} else if !same {
+			changes = append(changes, fmt.Sprintf("%s changed (was %.7s, now %.7s)", name, recorded.Hash, hash))
+		}
+	}
+
+	return changes, true
+}
+
+// Staleness is the first of the Changes, or "" if the target is up to
+// date
+func (state *BuildState) Staleness(directory string, inputFilename string, outputFilename string) (reason string, known bool) {
+	changes, known := state.Changes(directory, inputFilename, outputFilename)
+	if len(changes) > 0 {
+		reason = changes[0]
+	}
+	return reason, known
+}
+
+// HasRecordedToolchain reports whether the build state knows which
+// toolchain compiled inputFilename
+func (state *BuildState) HasRecordedToolchain(directory string, inputFilename string) bool {
+	relative, err := filepath.Rel(directory, inputFilename)
+	if err != nil {
+		return false
+	}
+
+	target, ok := state.Targets[filepath.ToSlash(relative)]
+	return ok && len(target.Toolchain) > 0
+}
+
+// RecordedHash is the hash which filename had when the target built
+// from document was last compiled, if the state knows it
+func (state *BuildState) RecordedHash(directory string, document string, filename string) (string, bool) {
+	relativeDocument, err := filepath.Rel(directory, document)
+	if err != nil {
+		return "", false
+	}
+
+	target, ok := state.Targets[filepath.ToSlash(relativeDocument)]
+	if !ok || target.Outcome == failedOutcome {
+		return "", false
+	}
+
+	relative, err := filepath.Rel(directory, filename)
+	if err != nil {
+		return "", false
+	}
+
+	input, ok := target.Inputs[filepath.ToSlash(relative)]
+	return input.Hash, ok
+}
+
+// RecordedInputs lists the files, as absolute paths, which were read
+// by the last successful compilation of inputFilename
+func (state *BuildState) RecordedInputs(directory string, inputFilename string) []string {
+	var inputs []string
+
+	relative, err := filepath.Rel(directory, inputFilename)
+	if err != nil {
+		return inputs
+	}
+
+	target, ok := state.Targets[filepath.ToSlash(relative)]
+	if !ok || target.Outcome == failedOutcome {
+		return inputs
+	}
+
+	for name := range target.Inputs {
+		inputs = append(inputs, filepath.Join(directory, filepath.FromSlash(name)))
+	}
+	sort.Strings(inputs)
+
+	return inputs
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentFlushesKeepEveryTarget(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	// another copy of xake, working on the same repository, has a
+	// store of its own
+	other := &buildStateStore{
+		directory: directory,
+		state:     LoadBuildState(directory),
+		recorded:  make(map[string]*TargetState),
+	}
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			filename := filepath.Join(directory, fmt.Sprintf("ours%d.tex", i))
+			if err := RecordBuildState(directory, filename, TargetState{Outcome: compiledOutcome}); err != nil {
+				t.Error(err)
+			}
+			FlushBuildStates()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			FlushBuildStates()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			other.recorded[fmt.Sprintf("theirs%d.tex", i)] = &TargetState{Outcome: compiledOutcome}
+			if err := other.flush(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	FlushBuildStates()
+
+	state := LoadBuildState(directory)
+	for i := 0; i < rounds; i++ {
+		for _, name := range []string{fmt.Sprintf("ours%d.tex", i), fmt.Sprintf("theirs%d.tex", i)} {
+			if _, ok := state.Targets[name]; !ok {
+				t.Errorf("%s was lost", name)
+			}
+		}
+	}
+
+	if exists(filepath.Join(directory, stateDirectory, buildStateLockFilename)) {
+		t.Errorf("the lock was left behind")
+	}
+}
+
+func TestStaleLockIsBrokenOnce(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{stateDirectory + "/" + buildStateLockFilename: "12345\n"})
+	past := time.Now().Add(-2 * buildStateLockTimeout)
+	os.Chtimes(filepath.Join(directory, stateDirectory, buildStateLockFilename), past, past)
+
+	var mutex sync.Mutex
+	holders, most := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockBuildState(directory)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mutex.Lock()
+			holders++
+			if holders > most {
+				most = holders
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			holders--
+			mutex.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if most != 1 {
+		t.Errorf("%d copies of xake held the lock at once", most)
+	}
+}
+
+func TestBreakStaleLock(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "state.lock")
+	age := func(path string, age time.Duration) {
+		when := time.Now().Add(-age)
+		os.Chtimes(path, when, when)
+	}
+
+	tests := []struct {
+		name    string
+		lockAge time.Duration
+		breaker bool
+		removed bool
+	}{
+		{"fresh lock", time.Second, false, false},
+		{"stale lock", 2 * buildStateLockTimeout, false, true},
+		{"stale lock being broken by someone else", 2 * buildStateLockTimeout, true, false},
+	}
+
+	for _, test := range tests {
+		ioutil.WriteFile(path, []byte("12345\n"), 0644)
+		age(path, test.lockAge)
+		os.Remove(path + ".break")
+		if test.breaker {
+			ioutil.WriteFile(path+".break", nil, 0644)
+		}
+
+		if err := breakStaleLock(path); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if removed := !exists(path); removed != test.removed {
+			t.Errorf("%s: removed is %v, expected %v", test.name, removed, test.removed)
+		}
+		if exists(path+".break") != test.breaker {
+			t.Errorf("%s: the breaker was not cleaned up", test.name)
+		}
+	}
+
+	// whoever held a lock which was broken leaves the new one alone
+	unlock, err := lockBuildState(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := filepath.Join(directory, stateDirectory, buildStateLockFilename)
+	ioutil.WriteFile(lock+".theirs", []byte("67890\n"), 0644)
+	os.Rename(lock+".theirs", lock)
+	unlock()
+	if !exists(lock) {
+		t.Errorf("unlocking removed another xake's lock")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"gopkg.in/cheggaaa/pb.v1"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var deletableExtensions = []string{
@@ -80,8 +81,25 @@ func RemoveBuiltFiles(pathname string) error {
 
 	var toDelete []string
 
+	// Ignored directories are left alone entirely, but a file is only
+	// spared if the .tex file it would have come from is ignored, since
+	// ignore files often list build products like *.log
+	ignore := NewIgnoreMatcher(repository)
+
 	var visit = func(path string, f os.FileInfo, err error) error {
+		if f != nil && f.IsDir() {
+			if ignored, _ := ignore.Ignored(path); ignored {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if isDeletable(path) {
+			source := strings.TrimSuffix(path, filepath.Ext(path)) + ".tex"
+			if ignored, _ := ignore.Ignored(source); ignored {
+				return nil
+			}
+
 			if !included[path] {
 				toDelete = append(toDelete, path)
 			}
@@ -1,81 +1,15 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-var extensions = []string{
-	"aux",
-	"4ct",
-	"4tc",
-	"oc",
-	"md5",
-	"dpth",
-	"out",
-	"jax",
-	"idv",
-	"lg",
-	"tmp",
-	"xref",
-	"log",
-	"auxlock",
-	"dvi",
-	"pdf",
-	"scmd",
-	"sout",
-}
-
-func clean(filename string) {
-	for _, extension := range extensions {
-		f := strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + extension
-		os.Remove(f)
-	}
-}
-
-func pdflatex(filename string) ([]byte, error) {
-	cmdName := "pdflatex"
-	tikzexport := "\"\\PassOptionsToClass{tikzexport}{ximera}\\PassOptionsToClass{xake}{ximera}\\PassOptionsToClass{xake}{xourse}\\nonstopmode\\input{" + filepath.Base(filename) + "}\""
-	cmdArgs := []string{"-file-line-error", "-shell-escape", tikzexport}
-
-	cmd := exec.Command(cmdName, cmdArgs...)
-	cmd.Dir = filepath.Dir(filename)
-
-	cmdOut, err := cmd.Output()
-
-	return cmdOut, err
-}
-
-func htlatex(filename string) ([]byte, error) {
-	cmdName := "htlatex"
-	cmdArgs := []string{filepath.Base(filename), "ximera,charset=utf-8,-css", " -cunihtf -utf8", "", "--interaction=nonstopmode -shell-escape -file-line-error"}
-
-	cmd := exec.Command(cmdName, cmdArgs...)
-	cmd.Dir = filepath.Dir(filename)
-
-	cmdOut, err := cmd.Output()
-
-	return cmdOut, err
-}
-
-func sage(filename string) ([]byte, error) {
-	cmdName := "sage"
-	cmdArgs := []string{filepath.Base(filename)}
-	cmd := exec.Command(cmdName, cmdArgs...)
-	cmd.Dir = filepath.Dir(filename)
-
-	cmdOut, err := cmd.Output()
-
-	return cmdOut, err
-}
-
 func FindLabelAnchorsInHtml(htmlFilename string) ([]string, error) {
 	var ids []string
 
@@ -170,131 +104,142 @@ func transformXourse(directory string, filename string, doc *goquery.Document) {
 	return
 }
 
-func transformHtml(directory string, filename string) error {
-	htmlFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+func Compile(ctx context.Context, directory string, filename string) ([]byte, error) {
+	return CompileWithReport(ctx, directory, filename, nil)
+}
 
-	f, err := os.Open(htmlFilename)
-	defer f.Close()
+// CompileWithReport is Compile, recording how long each step took,
+// and whether the cache was used, in report if it is not nil
+func CompileWithReport(ctx context.Context, directory string, filename string, report *FileReport) (output []byte, err error) {
+	backendName, backend, err := BackendFor(filename)
 	if err != nil {
-		return err
+		log.Error(err)
+		return []byte{}, err
 	}
+	log.Debug("Using the " + backendName + " backend for " + filename)
 
-	doc, err := goquery.NewDocumentFromReader(f)
-	if err != nil {
-		return err
+	dependencies, _ := compiledDependencies(filename, nil)
+	inputs := SnapshotInputs(directory, dependencies)
+	outcome := compiledOutcome
+	var recorded []string
+	defer func() {
+		if err != errInterrupted {
+			recordCompilation(directory, filename, backendName, backend, inputs, recorded, outcome, err)
+		}
+	}()
+
+	cacheKey := ""
+	if useBuildCache {
+		cacheKey, err = BuildCacheKey(directory, filename, backendName, backend)
+		if err != nil {
+			log.Debug("Not using the cache for " + filename + ": " + err.Error())
+			cacheKey = ""
+		} else if RestoreFromBuildCache(cacheKey, filename, backendOutputs(backend)) {
+			log.Debug("Restored " + filename + " from the cache")
+			outcome = restoredOutcome
+			if report != nil {
+				report.CacheHit = true
+			}
+			return []byte{}, nil
+		}
 	}
 
-	xourseFile := false
-	doc.Find("meta[name=\"description\"]").Each(func(i int, s *goquery.Selection) {
-		content, exists := s.Attr("content")
+	log.Debug("Preparing a scratch directory for " + filename)
+	scratch, err := newScratchDirectory(directory, filename)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer scratch.remove()
 
-		if !exists {
-			log.Warn(htmlFilename + " is missing a content attribute on its meta[name=\"description\"]")
+	for _, step := range backend.Steps {
+		if !isStepApplicable(step, scratch.scratchFilename) {
+			log.Debug("Skipping " + step.Name + " for " + filename)
+			continue
 		}
 
-		if content == "xourse" {
-			xourseFile = true
+		log.Debug("Running " + step.Name + " for " + filename)
+
+		var output []byte
+		start := time.Now()
+		var passes []time.Duration
+		cached := false
+		if step.Converge {
+			var converged bool
+			output, passes, converged, err = runConvergingStep(ctx, step, scratch.scratchFilename)
+			if err == nil && !converged {
+				log.Warn(fmt.Sprintf("Cross-references in %s did not converge after %d passes of %s", filename, len(passes), step.Name))
+			}
+		} else if step.CacheKey != "" {
+			output, cached, err = runCachedStep(ctx, step, scratch.scratchFilename)
+		} else {
+			output, err = runBuildStep(ctx, step, scratch.scratchFilename)
 		}
-	})
+		report.addStep(step.Name, start, passes, cached, err)
 
-	log.Debug("Remove empty paragraphs of the form <p></p>")
-	doc.Find("p:empty").Each(func(i int, s *goquery.Selection) {
-		s.Remove()
-	})
+		if err != nil {
+			if step.AllowFailure && err != errInterrupted {
+				log.Debug(step.Name + " failed for " + filename + " but we will continue anyway")
+				continue
+			}
 
-	log.Debug("Add <meta> tags for all dependencies")
-	doc.Find("head").Each(func(_ int, s *goquery.Selection) {
-		dependencies, err := LatexDependencies(filename)
-		if err == nil {
-			// BADBAD: this does the wrong thing with xake compile
-			dependencies = append(dependencies, filename)
-
-			for _, dependency := range dependencies {
-				dependency, err := filepath.Rel(directory, dependency)
-
-				if err != nil {
-					continue
-				}
-
-				f, err := os.Open(dependency)
-				defer f.Close()
-
-				if err != nil {
-					continue
-				}
-
-				h := sha1.New()
-				if _, err := io.Copy(h, f); err == nil {
-					hash := fmt.Sprintf("%x", h.Sum(nil))
-					s.AppendHtml("<meta name=\"dependency\" content=\"" +
-						hash + " " +
-						dependency + "\">")
-				}
+			if err == errInterrupted {
+				return output, err
 			}
-		}
-	})
 
-	if xourseFile {
-		transformXourse(directory, filename, doc)
-	}
+			var diagnostics []Diagnostic
+			if step.LogFormat == sageLogFormat {
+				diagnostics = ParseSageOutput(scratch.scratchFilename, output)
+			} else {
+				diagnostics, _ = ReadTexLogDiagnostics(scratch.scratchFilename)
+			}
 
-	html, err := doc.Html()
-	if err != nil {
-		return err
+			return output, &CompileError{
+				Filename:    filename,
+				Step:        step.Name,
+				Err:         err,
+				Output:      output,
+				Diagnostics: diagnostics,
+			}
+		}
 	}
 
-	fileInfo, err := os.Stat(htmlFilename)
-	if err != nil {
-		return err
+	diagnostics, _ := ReadTexLogDiagnostics(scratch.scratchFilename)
+	for _, d := range diagnostics {
+		log.Debug(formatDiagnostic(d))
 	}
-
-	err = ioutil.WriteFile(htmlFilename, []byte(html), fileInfo.Mode())
-	if err != nil {
-		return err
+	if report != nil {
+		report.Diagnostics = diagnostics
 	}
 
-	return nil
-}
-
-func Compile(directory string, filename string) ([]byte, error) {
-
-	log.Debug("Cleaning files associated with " + filename)
-	clean(filename)
-
-	log.Debug("Running pdflatex for " + filename)
-	output, err := pdflatex(filename)
+	outputFilenames, err := scratch.copyOutputs(backendOutputs(backend))
 	if err != nil {
-		log.Error(string(output))
-		return output, err
-	}
-
-	sagetexFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".sagetex.sage"
-	if _, err := os.Stat(sagetexFilename); !os.IsNotExist(err) {
-		log.Debug("Running sage for " + filename)
-		sage(sagetexFilename)
+		return []byte{}, err
 	}
 
-	log.Debug("Running pdflatex again for " + filename)
-	output, err = pdflatex(filename)
+	err = scratch.copyFiguresOut()
 	if err != nil {
-		log.Error(err)
-		log.Error(string(output))
-		return output, err
+		log.Warn("Could not keep the TikZ figures of " + filename + ": " + err.Error())
 	}
 
-	log.Debug("Running htlatex on " + filename)
-	output, err = htlatex(filename)
+	recorded, err = scratch.recordedInputs()
 	if err != nil {
-		log.Error(err)
-		log.Error(string(output))
-		return output, err
+		log.Debug("No record of the files read for " + filename + ": " + err.Error())
 	}
 
 	log.Debug("Applying HTML transformations for " + filename)
-	err = transformHtml(directory, filename)
+	start := time.Now()
+	err = transformHtml(ctx, directory, filename, recorded)
+	report.addStep("transforms", start, nil, false, err)
 	if err != nil {
 		return []byte{}, err
 	}
 
+	if cacheKey != "" {
+		err = StoreInBuildCache(cacheKey, scratch.filename, outputFilenames, backendOutputs(backend))
+		if err != nil {
+			log.Warn("Could not save " + filename + " in the cache: " + err.Error())
+		}
+	}
+
 	return []byte{}, nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// configurationFilename is the name of the (optional) file at the
+// root of a repository which adjusts how xake builds that repository
+const configurationFilename = ".xake.json"
+
+// RepositoryConfiguration holds the settings read from .xake.json
+type RepositoryConfiguration struct {
+	// Backend names the backend used for files which do not
+	// request one with a "% !xake backend = NAME" comment
+	Backend string `json:"backend"`
+
+	// Backends adds to (or overrides) the built-in backends
+	Backends map[string]Backend `json:"backends"`
+
+	// Timeout bounds how long any single build step may run
+	Timeout string `json:"timeout"`
+
+	// MaxPasses caps how many times pdflatex is rerun while waiting
+	// for cross-references to converge
+	MaxPasses int `json:"maxPasses"`
+
+	// CacheUrl points to a server (such as `xake cache-server`)
+	// which shares compiled files among a team
+	CacheUrl string `json:"cacheUrl"`
+
+	// Transforms replaces the default chain of transformations
+	// applied to the HTML produced by htlatex
+	Transforms []Transform `json:"transforms"`
+}
+
+var configuration RepositoryConfiguration
+
+// LoadConfiguration reads .xake.json from the root of the given
+// repository; a missing file simply leaves the defaults in place.
+func LoadConfiguration(directory string) error {
+	filename := filepath.Join(directory, configurationFilename)
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Reading configuration from " + filename)
+	return json.Unmarshal(data, &configuration)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A CycleError reports files which (perhaps indirectly) input one
+// another, so that no order of compilation is possible
+type CycleError struct {
+	// Cycle[i] is read by the file Cycle[i-1] reads, and the last
+	// step leads back to the first
+	Cycle []cycleStep
+}
+
+type cycleStep struct {
+	From       string
+	Dependency TexDependency
+}
+
+// displayName names filename relative to the working directory, if
+// it can
+func displayName(filename string) string {
+	directory, err := os.Getwd()
+	if err != nil {
+		return filename
+	}
+
+	relative, err := filepath.Rel(directory, filename)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return filename
+	}
+
+	return relative
+}
+
+func (e *CycleError) Error() string {
+	lines := []string{"These files depend on one another in a cycle:"}
+	for _, step := range e.Cycle {
+		lines = append(lines, fmt.Sprintf("    %s:%d: \\%s{%s}",
+			displayName(step.From), step.Dependency.Line, step.Dependency.Command, displayName(step.Dependency.Filename)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// FindDependencyCycle looks for a cycle of inputs among the given
+// files and whatever they input, returning nil when there is none
+func FindDependencyCycle(filenames []string) *CycleError {
+	const (
+		unvisited = iota
+		visiting
+		finished
+	)
+
+	state := make(map[string]int)
+	var path []cycleStep
+
+	var visit func(filename string) *CycleError
+	visit = func(filename string) *CycleError {
+		state[filename] = visiting
+
+		dependencies, err := TexDependencies(filename)
+		if err == nil {
+			for _, dependency := range dependencies {
+				path = append(path, cycleStep{From: filename, Dependency: dependency})
+
+				switch state[dependency.Filename] {
+				case visiting:
+					// the cycle is the end of the path which starts
+					// at the dependency
+					for i, step := range path {
+						if step.From == dependency.Filename {
+							return &CycleError{Cycle: append([]cycleStep{}, path[i:]...)}
+						}
+					}
+				case unvisited:
+					if cycle := visit(dependency.Filename); cycle != nil {
+						return cycle
+					}
+				}
+
+				path = path[:len(path)-1]
+			}
+		}
+
+		state[filename] = finished
+		return nil
+	}
+
+	for _, filename := range filenames {
+		if state[filename] == unvisited {
+			if cycle := visit(filename); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
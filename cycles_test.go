@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFindDependencyCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		cycle []string
+	}{
+		{
+			name:  "self-loop",
+			files: map[string]string{"a.tex": "\\input{a}"},
+			cycle: []string{"a.tex:1 -> a.tex"},
+		},
+		{
+			name:  "two files",
+			files: map[string]string{"a.tex": "\\input{b}", "b.tex": "\n\\input{a}"},
+			cycle: []string{"a.tex:1 -> b.tex", "b.tex:2 -> a.tex"},
+		},
+		{
+			name: "diamond",
+			files: map[string]string{
+				"a.tex": "\\input{b}\n\\input{c}",
+				"b.tex": "\\input{d}",
+				"c.tex": "\\input{d}",
+				"d.tex": "",
+			},
+			cycle: nil,
+		},
+		{
+			name:  "commented out",
+			files: map[string]string{"a.tex": "% \\input{a}"},
+			cycle: nil,
+		},
+	}
+
+	for _, test := range tests {
+		directory, err := ioutil.TempDir("", "xake-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, directory, test.files)
+
+		var filenames []string
+		for name := range test.files {
+			filenames = append(filenames, filepath.Join(directory, name))
+		}
+		sort.Strings(filenames)
+
+		var cycle []string
+		if e := FindDependencyCycle(filenames); e != nil {
+			for _, step := range e.Cycle {
+				from, _ := filepath.Rel(directory, step.From)
+				to, _ := filepath.Rel(directory, step.Dependency.Filename)
+				cycle = append(cycle, fmt.Sprintf("%s:%d -> %s", from, step.Dependency.Line, to))
+			}
+		}
+
+		if !reflect.DeepEqual(cycle, test.cycle) {
+			t.Errorf("%s: FindDependencyCycle found %q, expected %q", test.name, cycle, test.cycle)
+		}
+		os.RemoveAll(directory)
+	}
+}
+
+func TestStaleDocumentsOnACycle(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	previous := repository
+	repository = directory
+	defer func() { repository = previous }()
+
+	// a and b input one another, and c reads b; only d is compiled
+	// and untouched since
+	writeFiles(t, directory, map[string]string{
+		"a.tex":  "\\input{b}",
+		"b.tex":  "\\input{a}",
+		"c.tex":  "\\input{b}",
+		"d.tex":  "",
+		"b.html": "<html></html>",
+		"c.html": "<html></html>",
+		"d.html": "<html></html>",
+	})
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a.tex", "b.tex", "c.tex", "d.tex"} {
+		os.Chtimes(filepath.Join(directory, name), past, past)
+	}
+
+	var filenames []string
+	for _, name := range []string{"a.tex", "b.tex", "c.tex", "d.tex"} {
+		filenames = append(filenames, filepath.Join(directory, name))
+	}
+
+	if FindDependencyCycle(filenames) == nil {
+		t.Fatal("the cycle was not found")
+	}
+
+	dirty, reasons := staleDocuments(filenames)
+
+	var found []string
+	for _, filename := range filenames {
+		if dirty[filename] {
+			found = append(found, filepath.Base(filename))
+		}
+	}
+
+	expected := []string{"a.tex", "b.tex", "c.tex"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("staleDocuments found %q dirty, expected %q (because %q)", found, expected, reasons)
+	}
+}
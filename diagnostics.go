@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// TeX wraps the lines it writes to the .log file at this many characters
+const texMaxPrintLine = 79
+
+// The number of warnings displayed for a failing file before we just
+// count the rest
+const maximumDisplayedWarnings = 5
+
+// A Diagnostic is a single error or warning found in a TeX log
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Context  string `json:"context"`
+}
+
+// A CompileError reports the step which failed while compiling a
+// file, together with whatever could be learned from the TeX log.
+type CompileError struct {
+	Filename    string
+	Step        string
+	Err         error
+	Output      []byte
+	Diagnostics []Diagnostic
+}
+
+func (e *CompileError) Error() string {
+	if _, ok := e.Err.(*TimeoutError); ok {
+		return fmt.Sprintf("%s: %s", e.Filename, e.Err)
+	}
+	return fmt.Sprintf("%s failed on %s: %s", e.Step, e.Filename, e.Err)
+}
+
+var (
+	fileLineError     = regexp.MustCompile("^(.+?):([0-9]+): (.*)$")
+	undefinedWarning  = regexp.MustCompile("^LaTeX Warning: (Reference|Citation) `([^']*)' on page [0-9]+ undefined on input line ([0-9]+)\\.")
+	overfullWarning   = regexp.MustCompile("^Overfull \\\\[hv]box \\(([^)]*)\\) .*at lines? ([0-9]+)")
+	undefinedOverall  = regexp.MustCompile("^LaTeX Warning: There were undefined references\\.")
+	contextLineNumber = regexp.MustCompile("^l\\.([0-9]+) ")
+)
+
+// readWrappedLine joins lines that TeX broke at texMaxPrintLine
+func readWrappedLine(lines []string, i int) (string, int) {
+	line := lines[i]
+	for len(lines[i]) == texMaxPrintLine && i+1 < len(lines) {
+		i++
+		line = line + lines[i]
+	}
+	return line, i
+}
+
+// readErrorContext gathers the lines following an error, up to the
+// blank line which TeX writes after the l.NN excerpt
+func readErrorContext(lines []string, i int) (string, int, int) {
+	var context []string
+	lineNumber := 0
+
+	for i+1 < len(lines) && len(context) < 6 {
+		next := lines[i+1]
+		if strings.TrimSpace(next) == "" || strings.HasPrefix(next, "! ") || fileLineError.MatchString(next) {
+			break
+		}
+		i++
+		context = append(context, next)
+
+		if matches := contextLineNumber.FindStringSubmatch(next); len(matches) > 0 {
+			lineNumber, _ = strconv.Atoi(matches[1])
+			// the line after l.NN finishes the excerpt
+			if i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+				i++
+				context = append(context, lines[i])
+			}
+			break
+		}
+	}
+
+	return strings.Join(context, "\n"), lineNumber, i
+}
+
+// ParseTexLog extracts errors, undefined references and overfull
+// boxes from the .log written while compiling filename
+func ParseTexLog(filename string, data []byte) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	texFile := filepath.Base(filename)
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		var line string
+		line, i = readWrappedLine(lines, i)
+
+		if matches := fileLineError.FindStringSubmatch(line); len(matches) > 0 {
+			lineNumber, _ := strconv.Atoi(matches[2])
+			var context string
+			context, _, i = readErrorContext(lines, i)
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     filepath.Clean(matches[1]),
+				Line:     lineNumber,
+				Severity: severityError,
+				Message:  matches[3],
+				Context:  context,
+			})
+			continue
+		}
+
+		if strings.HasPrefix(line, "! ") {
+			message := strings.TrimPrefix(line, "! ")
+			if message == "==> Fatal error occurred, no output PDF file produced!" {
+				continue
+			}
+			var context string
+			var lineNumber int
+			context, lineNumber, i = readErrorContext(lines, i)
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     texFile,
+				Line:     lineNumber,
+				Severity: severityError,
+				Message:  message,
+				Context:  context,
+			})
+			continue
+		}
+
+		if matches := undefinedWarning.FindStringSubmatch(line); len(matches) > 0 {
+			lineNumber, _ := strconv.Atoi(matches[3])
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     texFile,
+				Line:     lineNumber,
+				Severity: severityWarning,
+				Message:  fmt.Sprintf("%s `%s' undefined", matches[1], matches[2]),
+			})
+			continue
+		}
+
+		if undefinedOverall.MatchString(line) {
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     texFile,
+				Severity: severityWarning,
+				Message:  "There were undefined references",
+			})
+			continue
+		}
+
+		if matches := overfullWarning.FindStringSubmatch(line); len(matches) > 0 {
+			lineNumber, _ := strconv.Atoi(matches[2])
+			diagnostics = append(diagnostics, Diagnostic{
+				File:     texFile,
+				Line:     lineNumber,
+				Severity: severityWarning,
+				Message:  "Overfull box (" + matches[1] + ")",
+			})
+		}
+	}
+
+	return diagnostics
+}
+
+// ReadTexLogDiagnostics parses the .log file which TeX left next to filename
+func ReadTexLogDiagnostics(filename string) ([]Diagnostic, error) {
+	logFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".log"
+
+	data, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		return []Diagnostic{}, err
+	}
+
+	return ParseTexLog(filename, data), nil
+}
+
+func formatDiagnostic(d Diagnostic) string {
+	if d.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+	}
+	return fmt.Sprintf("%s: %s", d.File, d.Message)
+}
+
+// firstDiagnostic summarizes a failure in a line: the first error in
+// the TeX log, if there is one
+func firstDiagnostic(report FileReport) string {
+	for _, d := range report.Diagnostics {
+		if d.Severity != severityWarning {
+			return formatDiagnostic(d)
+		}
+	}
+	return report.Error
+}
+
+// lastLines is what we show when a log yields no diagnostics at all
+func lastLines(output []byte, count int) string {
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DisplayCompileError prints a concise summary of why a file failed
+// to compile, rather than the entire output of TeX
+func DisplayCompileError(err error) {
+	compileError, ok := err.(*CompileError)
+	if !ok {
+		log.Error(err)
+		return
+	}
+
+	log.Error(compileError)
+
+	errorCount := 0
+	var warnings []Diagnostic
+
+	for _, d := range compileError.Diagnostics {
+		if d.Severity == severityWarning {
+			warnings = append(warnings, d)
+			continue
+		}
+
+		errorCount++
+		log.Error(formatDiagnostic(d))
+		if d.Context != "" {
+			for _, line := range strings.Split(d.Context, "\n") {
+				log.Error("    " + line)
+			}
+		}
+	}
+
+	for i, d := range warnings {
+		if i == maximumDisplayedWarnings {
+			log.Warn(fmt.Sprintf("...and %d more warnings", len(warnings)-maximumDisplayedWarnings))
+			break
+		}
+		log.Warn(formatDiagnostic(d))
+	}
+
+	if errorCount == 0 && len(compileError.Output) > 0 {
+		log.Error(lastLines(compileError.Output, 20))
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTexLog(t *testing.T) {
+	// a message which TeX wrapped at texMaxPrintLine characters
+	wrapped := "./activity.tex:3: Package pgfkeys Error: I do not know the key '/tikz/arrow spr"
+	if len(wrapped) != texMaxPrintLine {
+		t.Fatalf("the wrapped line has %d characters, not %d", len(wrapped), texMaxPrintLine)
+	}
+
+	tests := []struct {
+		name        string
+		log         string
+		diagnostics []Diagnostic
+	}{
+		{
+			name: "file-line-error",
+			log:  "(./activity.tex\n./activity.tex:12: Undefined control sequence.\nl.12 \\foo\n          bar\n\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 12, Severity: severityError, Message: "Undefined control sequence.", Context: "l.12 \\foo\n          bar"},
+			},
+		},
+		{
+			name: "error in another file",
+			log:  "./chapter/macros.tex:4: LaTeX Error: File `missing.sty' not found.\n\nType X to quit or <RETURN> to proceed,\n",
+			diagnostics: []Diagnostic{
+				{File: "chapter/macros.tex", Line: 4, Severity: severityError, Message: "LaTeX Error: File `missing.sty' not found."},
+			},
+		},
+		{
+			name: "classic error",
+			log:  "! Missing $ inserted.\n<inserted text> \n                $\nl.7 x^\n      2\n\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 7, Severity: severityError, Message: "Missing $ inserted.", Context: "<inserted text> \n                $\nl.7 x^\n      2"},
+			},
+		},
+		{
+			name:        "fatal error summary",
+			log:         "! ==> Fatal error occurred, no output PDF file produced!\n",
+			diagnostics: nil,
+		},
+		{
+			name: "wrapped line",
+			log:  wrapped + "ead'.\n\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 3, Severity: severityError, Message: "Package pgfkeys Error: I do not know the key '/tikz/arrow spread'."},
+			},
+		},
+		{
+			name: "undefined reference",
+			log:  "LaTeX Warning: Reference `fig:graph' on page 2 undefined on input line 33.\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 33, Severity: severityWarning, Message: "Reference `fig:graph' undefined"},
+			},
+		},
+		{
+			name: "undefined citation",
+			log:  "LaTeX Warning: Citation `knuth' on page 1 undefined on input line 5.\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 5, Severity: severityWarning, Message: "Citation `knuth' undefined"},
+			},
+		},
+		{
+			name: "undefined references overall",
+			log:  "LaTeX Warning: There were undefined references.\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Severity: severityWarning, Message: "There were undefined references"},
+			},
+		},
+		{
+			name: "overfull box",
+			log:  "Overfull \\hbox (12.3pt too wide) in paragraph at lines 10--12\n[]\\OT1/cmr/m/n/10 text\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 10, Severity: severityWarning, Message: "Overfull box (12.3pt too wide)"},
+			},
+		},
+		{
+			name: "windows line endings",
+			log:  "./activity.tex:2: Undefined control sequence.\r\nl.2 \\foo\r\n\r\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 2, Severity: severityError, Message: "Undefined control sequence.", Context: "l.2 \\foo"},
+			},
+		},
+		{
+			name:        "nothing wrong",
+			log:         "This is pdfTeX, Version 3.14159265-2.6-1.40.21\nOutput written on activity.pdf (1 page, 1234 bytes).\n",
+			diagnostics: nil,
+		},
+	}
+
+	for _, test := range tests {
+		diagnostics := ParseTexLog("/tmp/scratch/activity.tex", []byte(test.log))
+		if !reflect.DeepEqual(diagnostics, test.diagnostics) {
+			t.Errorf("%s: ParseTexLog found\n%#v\nexpected\n%#v", test.name, diagnostics, test.diagnostics)
+		}
+	}
+}
+
+func TestParseTexLogFindsEverything(t *testing.T) {
+	log := strings.Join([]string{
+		"./activity.tex:8: Undefined control sequence.",
+		"l.8 \\foo",
+		"",
+		"LaTeX Warning: Reference `x' on page 1 undefined on input line 9.",
+		"Overfull \\hbox (1.0pt too wide) in paragraph at lines 20--21",
+		"LaTeX Warning: There were undefined references.",
+	}, "\n")
+
+	var found []string
+	for _, d := range ParseTexLog("activity.tex", []byte(log)) {
+		found = append(found, d.Severity+" "+formatDiagnostic(d))
+	}
+
+	expected := []string{
+		"error activity.tex:8: Undefined control sequence.",
+		"warning activity.tex:9: Reference `x' undefined",
+		"warning activity.tex:20: Overfull box (1.0pt too wide)",
+		"warning activity.tex: There were undefined references",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("ParseTexLog found %q, expected %q", found, expected)
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
-	"github.com/libgit2/git2go"
-	"github.com/stevenle/topsort"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -73,113 +71,31 @@ func HashObject(path string) (string, error) {
 
 /* IsClean compares filename to the current commit */
 func IsClean(repositoryPath string, filename string) (bool, error) {
-	//log.Debug("Checking whether " + filename + " matches what was committed in " + repositoryPath)
-
-	// git seems to prefer (require?) relative paths from the repo root
-	filename, err := filepath.Rel(repositoryPath, filename)
-	if err != nil {
-		return false, err
-	}
-
-	// Open the repository directory
-	repo, err := git.OpenRepository(repositoryPath)
+	r, err := openGitRepository(repositoryPath)
 	if err != nil {
 		return false, err
 	}
 
-	head, err := repo.Head()
+	err = r.refresh()
 	if err != nil {
 		return false, err
 	}
 
-	headCommit, err := repo.LookupCommit(head.Target())
-	if err != nil {
-		return false, err
-	}
-
-	tree, err := headCommit.Tree()
-	if err != nil {
-		return false, err
-	}
-
-	entry, err := tree.EntryByPath(filename)
-	if err != nil {
-		return false, err
-	}
-
-	// BADBAD: Just ignore symbolic links
-	if entry.Filemode == git.FilemodeLink {
-		return true, nil
-	}
-
-	sha := entry.Id.String()
-
-	hash, err := HashObject(filepath.Join(repositoryPath, filename))
-	if err != nil {
-		return false, err
-	}
-
-	return sha == hash, nil
-}
-
-func readTexCode(filename string) (string, error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return "", err
-	}
-
-	// Remove TeX comments
-	lines := strings.Split(string(data), "\n")
-	comments, _ := regexp.Compile("%.*")
-	for i, _ := range lines {
-		lines[i] = comments.ReplaceAllString(lines[i], "")
-	}
-	code := strings.Join(lines, "\n")
-
-	// I have no idea why this is necessary---can we delete this?
-	whitespace, _ := regexp.Compile("\\s")
-	code = whitespace.ReplaceAllString(code, "")
-
-	// Sometimes things are inside a verbatim environment; let's hackishly remove such things
-	verbatim, _ := regexp.Compile("\\\\begin{verbatim}.*\\\\end{verbatim}")
-	code = verbatim.ReplaceAllString(code, "")
-
-	return code, nil
+	return r.isClean(filename)
 }
 
 /* IncludedImages reads filename, looks for includegraphics
 /* and returns a list of all included graphic filenames */
 func IncludedImages(filename string) ([]string, error) {
-	code, err := readTexCode(filename)
-	if err != nil {
-		return []string{}, err
-	}
-
-	// Search for includegraphics commands and gather the filenames.
-	includers, _ := regexp.Compile("\\\\(includegraphics)\\s*{([^}]+)}")
-
-	matches := includers.FindAllStringSubmatch(code, -1)
-
 	var graphics []string
 
-	for _, m := range matches {
-		resolved, err := filepath.Abs(filepath.Join(filepath.Dir(filename), m[2]))
-		if err == nil {
-			f, err := os.Open(resolved)
-			defer f.Close()
-
-			// Should test for other possible extensions
-			if err == nil {
-				graphics = append(graphics, resolved)
-			} else {
-				f, err := os.Open(resolved + ".pdf")
-				defer f.Close()
+	images, err := ImageDependencies(filename)
+	if err != nil {
+		return graphics, err
+	}
 
-				if err == nil {
-					graphics = append(graphics, resolved+".pdf")
-				}
-			}
-		}
+	for _, image := range images {
+		graphics = append(graphics, image.Filename)
 	}
 
 	return graphics, nil
@@ -188,38 +104,15 @@ func IncludedImages(filename string) ([]string, error) {
 /* LatexDependencies reads filename, looks for inputs and includes,
 /* and returns a list of normalized paths to dependencies */
 func LatexDependencies(filename string) ([]string, error) {
-	code, err := readTexCode(filename)
-	if err != nil {
-		return []string{}, err
-	}
-
-	// Search for input or similar commands and gather the .tex filenames.
-	//
-	// Permit space between an input command and the filename in
-	// braces
-	includers, _ := regexp.Compile("\\\\(input|activity|include|includeonly)\\s*{([^}]+)}")
-
-	matches := includers.FindAllStringSubmatch(code, -1)
-
 	var dependencies []string
 
-	for _, m := range matches {
-		resolved, err := filepath.Abs(filepath.Join(filepath.Dir(filename), m[2]))
-		if err == nil {
-			f, err := os.Open(resolved)
-			defer f.Close()
-
-			if err == nil {
-				dependencies = append(dependencies, resolved)
-			} else {
-				f, err := os.Open(resolved + ".tex")
-				defer f.Close()
+	inputs, err := TexDependencies(filename)
+	if err != nil {
+		return dependencies, err
+	}
 
-				if err == nil {
-					dependencies = append(dependencies, resolved+".tex")
-				}
-			}
-		}
+	for _, input := range inputs {
+		dependencies = append(dependencies, input.Filename)
 	}
 
 	return dependencies, nil
@@ -227,58 +120,68 @@ func LatexDependencies(filename string) ([]string, error) {
 
 /* IsInRepository checks if filename is committed to the repo */
 func IsInRepository(repositoryPath string, filename string) (bool, error) {
-	//log.Debug("Checking whether " + filename + " is in the repository at " + repositoryPath)
-
-	// git seems to prefer (require?) relative paths from the repo root
-	filename, err := filepath.Rel(repositoryPath, filename)
+	r, err := openGitRepository(repositoryPath)
 	if err != nil {
 		return false, err
 	}
 
-	repo, err := git.OpenRepository(repositoryPath)
+	err = r.refresh()
 	if err != nil {
 		return false, err
 	}
 
-	head, err := repo.Head()
-	if err != nil {
-		return false, err
-	}
+	_, committed := r.committed(filename)
+	return committed, nil
+}
 
-	headCommit, err := repo.LookupCommit(head.Target())
-	if err != nil {
-		return false, err
-	}
+// skipGitDirectory keeps filepath.Walk out of .git, which holds
+// nothing we would compile
+func skipGitDirectory(path string, f os.FileInfo) bool {
+	return f != nil && f.IsDir() && f.Name() == ".git"
+}
 
-	tree, err := headCommit.Tree()
+func DisplayErrorsAboutUncommittedTexFiles(directory string) (result error) {
+	r, err := openGitRepository(directory)
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	_, err = tree.EntryByPath(filename)
+	err = r.refresh()
 	if err != nil {
-		return false, err
+		return err
 	}
 
-	return true, nil
-}
+	ignore := NewIgnoreMatcher(directory)
 
-func DisplayErrorsAboutUncommittedTexFiles(directory string) (result error) {
 	var visit = func(path string, f os.FileInfo, err error) error {
+		if skipGitDirectory(path, f) {
+			return filepath.SkipDir
+		}
+
+		if ignored, _ := ignore.IgnoredDuringWalk(path, f); ignored {
+			if f != nil && f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		passed, err := IsTexDocument(path)
 		if err != nil {
 			return nil
 		}
 
 		if passed {
-			committed, _ := IsInRepository(directory, path)
+			_, committed := r.committed(path)
 			if committed {
-				clean, _ := IsClean(directory, path)
+				clean, _ := r.isClean(path)
 
 				if !clean {
 					log.Error(path + " differs from what was committed to the repository")
 					result = errors.New("Some source files are not committed to the repository")
 				}
+			} else if r.staged(path) {
+				log.Error(path + " has been added but not committed to the repository")
+				result = errors.New("Some source files are not committed to the repository")
 			} else {
 				log.Error(path + " is not committed to the repository")
 				result = errors.New("Some source files are not committed to the repository")
@@ -288,7 +191,7 @@ func DisplayErrorsAboutUncommittedTexFiles(directory string) (result error) {
 		return nil
 	}
 
-	err := filepath.Walk(directory, visit)
+	err = filepath.Walk(directory, visit)
 	if err != nil {
 		return err
 	}
@@ -296,10 +199,57 @@ func DisplayErrorsAboutUncommittedTexFiles(directory string) (result error) {
 	return
 }
 
+// A SkippedFile is a file, or a whole directory, which was passed
+// over while looking for files in the repository, and why
+type SkippedFile struct {
+	Filename string
+	Reason   string
+}
+
 func FilesInRepository(directory string, condition func(string) (bool, error)) ([]string, error) {
+	files, _, err := ScanRepository(directory, condition)
+	return files, err
+}
+
+// ScanRepository lists the committed files in the repository which
+// satisfy condition, along with those (and the directories) which were
+// skipped because they are ignored; uncommitted files are warned about
+func ScanRepository(directory string, condition func(string) (bool, error)) ([]string, []SkippedFile, error) {
 	var files []string
+	var skipped []SkippedFile
+
+	// HEAD and the index are read once, rather than for every file
+	r, err := openGitRepository(directory)
+	if err != nil {
+		return []string{}, skipped, err
+	}
+
+	err = r.refresh()
+	if err != nil {
+		return []string{}, skipped, err
+	}
+
+	ignore := NewIgnoreMatcher(directory)
 
 	var visit = func(path string, f os.FileInfo, err error) error {
+		if skipGitDirectory(path, f) {
+			return filepath.SkipDir
+		}
+
+		rel, _ := filepath.Rel(directory, path)
+
+		if ignored, pattern := ignore.IgnoredDuringWalk(path, f); ignored {
+			if f != nil && f.IsDir() {
+				skipped = append(skipped, SkippedFile{Filename: path, Reason: "ignored by " + pattern.String()})
+				return filepath.SkipDir
+			}
+
+			if passed, _ := condition(path); passed {
+				skipped = append(skipped, SkippedFile{Filename: path, Reason: "ignored by " + pattern.String()})
+			}
+			return nil
+		}
+
 		passed, err := condition(path)
 		// Ignore errors from the condition test
 		if err != nil {
@@ -307,28 +257,23 @@ func FilesInRepository(directory string, condition func(string) (bool, error)) (
 		}
 
 		if passed {
-			committed, err := IsInRepository(directory, path)
-			// Things fail to be in the repository when an error occurs
-			if err != nil {
-				return nil
-			}
-
-			if committed {
-				clean, err := IsClean(directory, path)
+			if _, committed := r.committed(path); committed {
+				clean, err := r.isClean(path)
 
 				if err != nil {
 					return err
 				}
 
 				if !clean {
-					log.Warn(path + " is not committed to the repository")
+					log.Warn(rel + " differs from what has been committed to the repository")
 				}
 
 				files = append(files, path)
 
+			} else if r.staged(path) {
+				log.Warn(rel + " has been added but not committed and will be ignored.")
 			} else {
-				rel, _ := filepath.Rel(directory, path)
-				log.Warn(rel + " differs from what has been committed and will be be ignored.")
+				log.Warn(rel + " is not committed to the repository and will be ignored.")
 			}
 		}
 
@@ -336,29 +281,39 @@ func FilesInRepository(directory string, condition func(string) (bool, error)) (
 	}
 
 	log.Debug("Recursively listing all files in " + directory)
-	err := filepath.Walk(directory, visit)
+	err = filepath.Walk(directory, visit)
 	if err != nil {
-		return []string{}, err
+		return []string{}, skipped, err
 	}
 
-	return files, nil
+	return files, skipped, nil
 }
 
 func IsTexUpToDate(inputFilename string, outputFilename string) (bool, error) {
+	reason, err := texStaleness(inputFilename, outputFilename)
+	return reason == "", err
+}
+
+// texStaleness explains why the HTML produced from a .tex file is out
+// of date, using the hashes recorded in its dependency metadata, and
+// returns "" when it is up to date
+func texStaleness(inputFilename string, outputFilename string) (string, error) {
 	f, err := os.Open(outputFilename)
 	defer f.Close()
 
 	if err != nil {
-		return IsUpToDateBasedOnTime(inputFilename, outputFilename)
+		return timeStaleness(inputFilename, outputFilename)
 	}
 
 	doc, err := goquery.NewDocumentFromReader(f)
 	if err != nil {
-		return IsUpToDateBasedOnTime(inputFilename, outputFilename)
+		return timeStaleness(inputFilename, outputFilename)
 	}
 
-	clean := true
+	reason := ""
 	anyDependencies := false
+	toolchain := make(map[string]string)
+	readToolchainMetadata(doc, toolchain)
 
 	doc.Find("meta[name=\"dependency\"]").Each(func(i int, s *goquery.Selection) {
 		content, exists := s.Attr("content")
@@ -387,22 +342,36 @@ func IsTexUpToDate(inputFilename string, outputFilename string) (bool, error) {
 			if _, err := io.Copy(h, f); err == nil {
 				trueHash := fmt.Sprintf("%x", h.Sum(nil))
 
-				if trueHash != oldHash {
+				if trueHash != oldHash && reason == "" {
 					log.Debug(inputFilename + " not up to date because " + dependency + " changed")
-					clean = false
+					reason = dependency + " changed"
 				}
 			}
 		}
 	})
 
 	if anyDependencies == false {
-		return IsUpToDateBasedOnTime(inputFilename, outputFilename)
+		return timeStaleness(inputFilename, outputFilename)
+	}
+
+	if reason == "" {
+		if changes := ToolchainChanges(inputFilename, "", toolchain); len(changes) > 0 {
+			log.Debug(inputFilename + " not up to date because " + changes[0])
+			reason = changes[0]
+		}
 	}
 
-	return clean, nil
+	return reason, nil
 }
 
 func IsUpToDateBasedOnTime(inputFilename string, outputFilename string) (bool, error) {
+	reason, err := timeStaleness(inputFilename, outputFilename)
+	return reason == "", err
+}
+
+// timeStaleness compares modification times, returning "" when the
+// output is newer than the input
+func timeStaleness(inputFilename string, outputFilename string) (string, error) {
 	inputInfo, err := os.Stat(inputFilename)
 	// nonexistent files are viewed as having a very old modification time
 	inputTime := time.Unix(0, 0)
@@ -412,23 +381,34 @@ func IsUpToDateBasedOnTime(inputFilename string, outputFilename string) (bool, e
 
 	outputInfo, err := os.Stat(outputFilename)
 	outputTime := time.Unix(0, 0)
+	outputMissing := err != nil
 	if err == nil {
 		outputTime = outputInfo.ModTime()
 	}
 
 	if inputTime.After(outputTime) {
-		return false, nil
+		if outputMissing {
+			return filepath.Base(outputFilename) + " is missing", nil
+		}
+		return filepath.Base(inputFilename) + " is newer than " + filepath.Base(outputFilename), nil
 	}
 
-	return true, nil
+	return "", nil
 }
 
 func IsUpToDate(inputFilename string, outputFilename string) (bool, error) {
+	reason, err := Staleness(inputFilename, outputFilename)
+	return reason == "", err
+}
+
+// Staleness explains why outputFilename needs to be rebuilt from
+// inputFilename, or returns "" when it is up to date
+func Staleness(inputFilename string, outputFilename string) (string, error) {
 	if filepath.Ext(inputFilename) == ".tex" {
-		return IsTexUpToDate(inputFilename, outputFilename)
+		return texStaleness(inputFilename, outputFilename)
 	}
 
-	return IsUpToDateBasedOnTime(inputFilename, outputFilename)
+	return timeStaleness(inputFilename, outputFilename)
 }
 
 func TexFilesInRepository(directory string) ([]string, error) {
@@ -439,88 +419,24 @@ func TexFilesInRepository(directory string) ([]string, error) {
 /* (and its subdirectories) and returns the list of files
 /* that require compilation */
 func NeedingCompilation(directory string) ([]string, map[string][]string, error) {
-	var results []string
-	graph := topsort.NewGraph()
-	dependencyGraph := make(map[string][]string)
-
 	filenames, err := TexFilesInRepository(directory)
 
 	if err != nil {
-		return results, dependencyGraph, err
-	}
-
-	dirty := make(map[string]bool)
-
-	log.Debug("Determine if file are up-to-date.")
-	for _, filename := range filenames {
-		graph.AddNode(filename)
-
-		outputFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
-		good, err := IsUpToDate(filename, outputFilename)
-		if err == nil {
-			dirty[filename] = !good
-		} else {
-			dirty[filename] = true
-		}
-	}
-
-	log.Debug("Propagate dirt across dependencies.")
-	for {
-		dirtMoving := false
-
-		for _, filename := range filenames {
-			if !dirty[filename] {
-				dependencies, err := LatexDependencies(filename)
-				if err == nil {
-					for _, dependency := range dependencies {
-						if dirty[dependency] {
-							dirty[filename] = true
-							dirtMoving = true
-						}
-					}
-				}
-			}
-		}
-
-		if !dirtMoving {
-			break
-		}
+		return []string{}, make(map[string][]string), err
 	}
 
-	log.Debug("Build dependency graph.")
-	for _, filename := range filenames {
-		if dirty[filename] {
-			dependencies, err := LatexDependencies(filename)
-			if err == nil {
-				for _, dependency := range dependencies {
-					graph.AddEdge(filename, dependency)
-					if dirty[dependency] {
-						dependencyGraph[filename] = append(dependencyGraph[filename], dependency)
-					}
-				}
-			}
-		}
-	}
+	return NeedingCompilationAmong(filenames)
+}
 
-	log.Debug("Perform topological sort on dependencies.")
-	added := make(map[string]bool)
-	for _, filename := range filenames {
-		if dirty[filename] {
-			sorted, err := graph.TopSort(filename)
-			if err == nil {
-				for _, orderedName := range sorted {
-					if dirty[orderedName] {
-						if !added[orderedName] {
-							results = append(results, orderedName)
-							added[orderedName] = true
-						}
-					}
-				}
-			}
-		}
+// NeedingCompilationAmong is NeedingCompilation restricted to the
+// given files; dependencies outside of filenames are treated as clean.
+func NeedingCompilationAmong(filenames []string) ([]string, map[string][]string, error) {
+	plan, err := PlanCompilation(filenames)
+	if err != nil {
+		return []string{}, make(map[string][]string), err
 	}
 
-	return results, dependencyGraph, nil
+	return plan.Files(), plan.DependencyGraph(), nil
 }
 
 func identifyFilesAssociatedWithHtmlFile(htmlFilename string) ([]string, error) {
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libgit2/git2go"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A gitEntry is a file in HEAD's tree or in the index
+type gitEntry struct {
+	Id   string
+	Mode git.Filemode
+}
+
+// A gitRepository is a shared handle on a repository, along with its
+// HEAD tree and its index read into maps, so that looking up a file
+// does not mean opening the repository and walking to its tree again
+type gitRepository struct {
+	path string
+	repo *git.Repository
+
+	mutex         sync.Mutex
+	headId        string
+	head          map[string]gitEntry
+	indexModTime  time.Time
+	indexSize     int64
+	indexReadTime time.Time
+	index         map[string]gitEntry
+}
+
+var gitRepositories = make(map[string]*gitRepository)
+var gitRepositoriesMutex sync.Mutex
+
+// openGitRepository returns the handle on the repository at
+// repositoryPath, opening it the first time it is asked for
+func openGitRepository(repositoryPath string) (*gitRepository, error) {
+	gitRepositoriesMutex.Lock()
+	defer gitRepositoriesMutex.Unlock()
+
+	if r, ok := gitRepositories[repositoryPath]; ok {
+		return r, nil
+	}
+
+	log.Debug("Opening repository " + repositoryPath)
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &gitRepository{path: repositoryPath, repo: repo}
+	err = r.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	gitRepositories[repositoryPath] = r
+	return r, nil
+}
+
+// refresh rereads HEAD's tree and the index, but only if they have
+// changed since we last read them
+func (r *gitRepository) refresh() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	head, err := r.repo.Head()
+	if err != nil {
+		return err
+	}
+
+	if r.head == nil || head.Target().String() != r.headId {
+		err = r.readHead(head.Target())
+		if err != nil {
+			return err
+		}
+	}
+
+	indexFilename := filepath.Join(r.repo.Path(), "index")
+	info, err := os.Stat(indexFilename)
+	if err != nil {
+		// a repository with nothing staged may have no index at all
+		r.index = make(map[string]gitEntry)
+		r.indexModTime = time.Time{}
+		r.indexSize = 0
+		r.indexReadTime = time.Time{}
+		return nil
+	}
+
+	if !r.indexIsCurrent(info) {
+		readTime := time.Now()
+		err = r.readIndex(indexFilename)
+		if err != nil {
+			return err
+		}
+		r.indexModTime = info.ModTime()
+		r.indexSize = info.Size()
+		r.indexReadTime = readTime
+	}
+
+	return nil
+}
+
+// indexIsCurrent reports whether the index we read is still the one
+// described by info.  The modification time alone is not enough: git
+// may rewrite the index within the same tick of a coarse clock, so an
+// index modified within a second of our reading it is read again
+func (r *gitRepository) indexIsCurrent(info os.FileInfo) bool {
+	if r.index == nil {
+		return false
+	}
+
+	if !info.ModTime().Equal(r.indexModTime) || info.Size() != r.indexSize {
+		return false
+	}
+
+	return info.ModTime().Add(time.Second).Before(r.indexReadTime)
+}
+
+func (r *gitRepository) readHead(target *git.Oid) error {
+	log.Debug("Reading the tree of " + target.String())
+
+	commit, err := r.repo.LookupCommit(target)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+
+	head := make(map[string]gitEntry)
+	err = tree.Walk(func(root string, entry *git.TreeEntry) int {
+		if entry.Type != git.ObjectTree {
+			head[filepath.ToSlash(filepath.Join(root, entry.Name))] = gitEntry{
+				Id:   entry.Id.String(),
+				Mode: entry.Filemode,
+			}
+		}
+		return 0
+	})
+	if err != nil {
+		return err
+	}
+
+	r.head = head
+	r.headId = target.String()
+	return nil
+}
+
+func (r *gitRepository) readIndex(indexFilename string) error {
+	log.Debug("Reading the index " + indexFilename)
+
+	index, err := git.OpenIndex(indexFilename)
+	if err != nil {
+		return err
+	}
+	defer index.Free()
+
+	entries := make(map[string]gitEntry)
+	count := index.EntryCount()
+	for i := uint(0); i < count; i++ {
+		entry, err := index.EntryByIndex(i)
+		if err != nil {
+			return err
+		}
+		entries[entry.Path] = gitEntry{Id: entry.Id.String(), Mode: entry.Mode}
+	}
+
+	r.index = entries
+	return nil
+}
+
+// relative names filename as git does, relative to the repository
+// root with forward slashes
+func (r *gitRepository) relative(filename string) (string, error) {
+	relative, err := filepath.Rel(r.path, filename)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relative), nil
+}
+
+// committed looks up filename in HEAD's tree
+func (r *gitRepository) committed(filename string) (gitEntry, bool) {
+	relative, err := r.relative(filename)
+	if err != nil {
+		return gitEntry{}, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.head[relative]
+	return entry, ok
+}
+
+// staged reports whether filename is in the index
+func (r *gitRepository) staged(filename string) bool {
+	relative, err := r.relative(filename)
+	if err != nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.index[relative]
+	return ok
+}
+
+// isClean compares filename on disk to what was committed
+func (r *gitRepository) isClean(filename string) (bool, error) {
+	entry, ok := r.committed(filename)
+	if !ok {
+		return false, fmt.Errorf("%s is not committed to the repository", filename)
+	}
+
+	// BADBAD: Just ignore symbolic links
+	if entry.Mode == git.FilemodeLink {
+		return true, nil
+	}
+
+	hash, err := HashObject(filename)
+	if err != nil {
+		return false, err
+	}
+
+	return entry.Id == hash, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"github.com/libgit2/git2go"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The synthetic repository has this many documents, grouped into
+// chapters which share a directory
+const (
+	benchmarkDocuments   = 2000
+	activitiesPerChapter = 100
+)
+
+// createSyntheticRepository commits the given number of activities to
+// a new repository in directory, grouped into chapters which each
+// have some macros and notes which are not documents
+func createSyntheticRepository(directory string, documents int) error {
+	repo, err := git.InitRepository(directory, false)
+	if err != nil {
+		return err
+	}
+
+	var filenames []string
+	write := func(filename string, contents string) error {
+		err := os.MkdirAll(filepath.Join(directory, filepath.Dir(filename)), 0755)
+		if err != nil {
+			return err
+		}
+
+		filenames = append(filenames, filename)
+		return ioutil.WriteFile(filepath.Join(directory, filename), []byte(contents), 0644)
+	}
+
+	for i := 0; i < documents; i++ {
+		chapter := fmt.Sprintf("chapter%03d", i/activitiesPerChapter)
+
+		if i%activitiesPerChapter == 0 {
+			err = write(filepath.Join(chapter, "macros.tex"), "\\newcommand{\\R}{\\mathbb{R}}\n")
+			if err != nil {
+				return err
+			}
+
+			err = write(filepath.Join(chapter, "notes.txt"), "Remember to write more activities.\n")
+			if err != nil {
+				return err
+			}
+		}
+
+		activity := fmt.Sprintf("\\documentclass{ximera}\n\\input{macros}\n\\title{Activity %d}\n\\begin{document}\n\\begin{abstract}\nActivity %d.\n\\end{abstract}\n\\maketitle\nLet $x \\in \\R$.\n\\end{document}\n", i, i)
+		err = write(filepath.Join(chapter, fmt.Sprintf("activity%03d.tex", i%activitiesPerChapter)), activity)
+		if err != nil {
+			return err
+		}
+	}
+
+	index, err := repo.Index()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		err = index.AddByPath(filepath.ToSlash(filename))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = index.Write()
+	if err != nil {
+		return err
+	}
+
+	oid, err := index.WriteTree()
+	if err != nil {
+		return err
+	}
+
+	tree, err := repo.LookupTree(oid)
+	if err != nil {
+		return err
+	}
+
+	signature := &git.Signature{Name: "xake", Email: "xake@localhost", When: time.Now()}
+	_, err = repo.CreateCommit("HEAD", signature, signature, "Synthetic repository", tree)
+	return err
+}
+
+// BenchmarkInfo times what `xake info` does in a synthetic repository:
+// listing the documents and finding those which need compilation.
+// Cold runs open the repository afresh, while warm runs find its HEAD
+// and index already read.
+func BenchmarkInfo(b *testing.B) {
+	directory, err := ioutil.TempDir("", "xake-benchmark-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	err = createSyntheticRepository(directory, benchmarkDocuments)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// the build state, and dependencies named in .html files, are
+	// found relative to the repository
+	previousRepository := repository
+	repository = directory
+	defer func() { repository = previousRepository }()
+
+	info := func(b *testing.B) {
+		filenames, err := TexFilesInRepository(directory)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = PlanCompilation(filenames)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			gitRepositoriesMutex.Lock()
+			delete(gitRepositories, directory)
+			gitRepositoriesMutex.Unlock()
+
+			info(b)
+		}
+	})
+
+	b.Run("warm", func(b *testing.B) {
+		info(b)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			info(b)
+		}
+	})
+}
+
+func TestIndexIsCurrent(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	indexFilename := filepath.Join(directory, "index")
+	past := time.Now().Add(-time.Minute).Truncate(time.Second)
+	index := func(contents string, modTime time.Time) os.FileInfo {
+		err := ioutil.WriteFile(indexFilename, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(indexFilename, modTime, modTime)
+		info, err := os.Stat(indexFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	read := index("index", past)
+	r := &gitRepository{
+		index:         make(map[string]gitEntry),
+		indexModTime:  read.ModTime(),
+		indexSize:     read.Size(),
+		indexReadTime: time.Now(),
+	}
+
+	tests := []struct {
+		name     string
+		info     os.FileInfo
+		readTime time.Time
+		current  bool
+	}{
+		{"unchanged", index("index", past), time.Now(), true},
+		{"rewritten", index("index", past.Add(time.Second)), time.Now(), false},
+		{"rewritten at the same time", index("longer index", past), time.Now(), false},
+		{"read as it was written", index("index", past), past.Add(time.Second / 2), false},
+	}
+
+	for _, test := range tests {
+		r.indexReadTime = test.readTime
+		if current := r.indexIsCurrent(test.info); current != test.current {
+			t.Errorf("%s: indexIsCurrent is %v, expected %v", test.name, current, test.current)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Documents in the graph are either xourses or activities; every
+// other node has the kind of dependency which brought it in
+const (
+	xourseNode   = "xourse"
+	activityNode = "activity"
+)
+
+// A GraphNode is a file in the repository's dependency graph
+type GraphNode struct {
+	Filename string `json:"filename"`
+	Kind     string `json:"kind"`
+	Dirty    bool   `json:"dirty"`
+	// Cycle marks the files which depend on one another in a cycle
+	Cycle bool `json:"cycle,omitempty"`
+}
+
+// A GraphEdge records that From reads To, and where it says so
+type GraphEdge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Command string `json:"command"`
+	Line    int    `json:"line"`
+}
+
+// A RepositoryGraph is every document in the repository along with
+// everything they depend on
+type RepositoryGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// hashFile computes the hash recorded in the dependency metadata
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// RecordedDependencyHashes reads the hashes of the dependencies
+// recorded in an .html file, keyed by their names relative to the
+// repository
+func RecordedDependencyHashes(htmlFilename string) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	f, err := os.Open(htmlFilename)
+	if err != nil {
+		return hashes, err
+	}
+	defer f.Close()
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		return hashes, err
+	}
+
+	doc.Find("meta[name=\"dependency\"]").Each(func(i int, s *goquery.Selection) {
+		content, exists := s.Attr("content")
+		fields := strings.Fields(content)
+		if exists && len(fields) > 1 {
+			hashes[strings.TrimPrefix(content, fields[0]+" ")] = fields[0]
+		}
+	})
+
+	return hashes, nil
+}
+
+// BuildRepositoryGraph scans every document in the repository, and
+// everything they read
+func BuildRepositoryGraph(directory string) (RepositoryGraph, error) {
+	var graph RepositoryGraph
+
+	documents, err := TexFilesInRepository(directory)
+	if err != nil {
+		return graph, err
+	}
+
+	// a graph with a cycle is still worth seeing, and the files on
+	// the cycle are those it is most worth seeing; they cannot be put
+	// in order, but we can still say which are dirty
+	dirty := make(map[string]bool)
+	onCycle := make(map[string]bool)
+	plan, err := PlanCompilation(documents)
+	if cycle, ok := err.(*CycleError); ok {
+		log.Warn(err)
+		dirty, _ = staleDocuments(documents)
+		for _, step := range cycle.Cycle {
+			onCycle[step.From] = true
+		}
+	} else if err != nil {
+		return graph, err
+	}
+
+	for _, filename := range plan.Files() {
+		dirty[filename] = true
+	}
+
+	kinds := make(map[string]string)
+	var order []string
+	addNode := func(filename string, kind string) {
+		if _, ok := kinds[filename]; !ok {
+			kinds[filename] = kind
+			order = append(order, filename)
+		}
+	}
+
+	for _, filename := range documents {
+		htmlFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+		if xourse, _ := isXourseHtmlFile(htmlFilename); xourse {
+			addNode(filename, xourseNode)
+		} else {
+			addNode(filename, activityNode)
+		}
+	}
+
+	scanned := make(map[string]bool)
+	queue := append([]string{}, documents...)
+	for len(queue) > 0 {
+		filename := queue[0]
+		queue = queue[1:]
+
+		if scanned[filename] {
+			continue
+		}
+		scanned[filename] = true
+
+		dependencies, err := FileDependencies(filename)
+		if err != nil {
+			continue
+		}
+
+		for _, dependency := range dependencies {
+			graph.Edges = append(graph.Edges, GraphEdge{
+				From:    filename,
+				To:      dependency.Filename,
+				Command: dependency.Command,
+				Line:    dependency.Line,
+			})
+
+			addNode(dependency.Filename, dependency.Kind)
+			if isTextualDependency(dependency) {
+				queue = append(queue, dependency.Filename)
+			}
+		}
+	}
+
+	// dependents remembers which documents read each file, so we can
+	// tell whether a file has changed since they were compiled
+	dependents := make(map[string][]string)
+	for _, document := range documents {
+		dependencies, err := AllDependencies(document)
+		if err == nil {
+			for _, dependency := range dependencies {
+				dependents[dependency] = append(dependents[dependency], document)
+			}
+		}
+	}
+
+	state := CurrentBuildState(directory)
+	for _, filename := range order {
+		node := GraphNode{Filename: filename, Kind: kinds[filename], Dirty: dirty[filename], Cycle: onCycle[filename]}
+
+		if !node.Dirty && node.Kind != xourseNode && node.Kind != activityNode {
+			node.Dirty = hasChangedSinceCompiled(directory, state, filename, dependents[filename])
+		}
+
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	return graph, nil
+}
+
+// hasChangedSinceCompiled reports whether filename differs from the
+// version recorded when any of the documents were last compiled,
+// according to the build state or else the documents' .html files
+func hasChangedSinceCompiled(directory string, state *BuildState, filename string, documents []string) bool {
+	relative, err := filepath.Rel(directory, filename)
+	if err != nil {
+		return false
+	}
+
+	hash, err := hashFile(filename)
+	if err != nil {
+		return false
+	}
+
+	for _, document := range documents {
+		if oldHash, ok := state.RecordedHash(directory, document, filename); ok {
+			if oldHash != hash {
+				return true
+			}
+			continue
+		}
+
+		htmlFilename := strings.TrimSuffix(document, filepath.Ext(document)) + ".html"
+		recorded, err := RecordedDependencyHashes(htmlFilename)
+		if err != nil {
+			continue
+		}
+
+		if oldHash, ok := recorded[relative]; ok && oldHash != hash {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reachable restricts the graph to what can be reached from filename,
+// following edges backwards (to what depends on filename) if reverse
+func (graph RepositoryGraph) Reachable(filename string, reverse bool) RepositoryGraph {
+	neighbors := make(map[string][]string)
+	for _, edge := range graph.Edges {
+		if reverse {
+			neighbors[edge.To] = append(neighbors[edge.To], edge.From)
+		} else {
+			neighbors[edge.From] = append(neighbors[edge.From], edge.To)
+		}
+	}
+
+	keep := make(map[string]bool)
+	queue := []string{filename}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if keep[current] {
+			continue
+		}
+		keep[current] = true
+		queue = append(queue, neighbors[current]...)
+	}
+
+	return graph.restrict(keep)
+}
+
+// DirtyOnly restricts the graph to what needs compiling, has changed
+// since it was last compiled, or lies on a cycle
+func (graph RepositoryGraph) DirtyOnly() RepositoryGraph {
+	keep := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		if node.Dirty || node.Cycle {
+			keep[node.Filename] = true
+		}
+	}
+
+	return graph.restrict(keep)
+}
+
+func (graph RepositoryGraph) restrict(keep map[string]bool) RepositoryGraph {
+	var result RepositoryGraph
+
+	for _, node := range graph.Nodes {
+		if keep[node.Filename] {
+			result.Nodes = append(result.Nodes, node)
+		}
+	}
+
+	for _, edge := range graph.Edges {
+		if keep[edge.From] && keep[edge.To] {
+			result.Edges = append(result.Edges, edge)
+		}
+	}
+
+	return result
+}
+
+// relativeTo names the files in the graph relative to directory
+func (graph RepositoryGraph) relativeTo(directory string) RepositoryGraph {
+	relative := func(filename string) string {
+		rel, err := filepath.Rel(directory, filename)
+		if err != nil {
+			return filename
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	result := RepositoryGraph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+
+	for _, node := range graph.Nodes {
+		node.Filename = relative(node.Filename)
+		result.Nodes = append(result.Nodes, node)
+	}
+
+	for _, edge := range graph.Edges {
+		edge.From = relative(edge.From)
+		edge.To = relative(edge.To)
+		result.Edges = append(result.Edges, edge)
+	}
+
+	return result
+}
+
+// DisplayGraphJson prints the graph as JSON
+func DisplayGraphJson(directory string, graph RepositoryGraph) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(graph.relativeTo(directory))
+}
+
+var dotShapes = map[string]string{
+	xourseNode:             "doubleoctagon",
+	activityNode:           "box",
+	inputDependency:        "note",
+	packageDependency:      "component",
+	classDependency:        "component",
+	listingDependency:      "note",
+	bibliographyDependency: "folder",
+	dataDependency:         "cylinder",
+	imageDependency:        "oval",
+}
+
+// DisplayGraphDot prints the graph in the DOT language of graphviz
+func DisplayGraphDot(directory string, graph RepositoryGraph) {
+	graph = graph.relativeTo(directory)
+
+	fmt.Println("digraph xake {")
+	fmt.Println("  rankdir=LR;")
+	for _, node := range graph.Nodes {
+		attributes := fmt.Sprintf("shape=%s", dotShapes[node.Kind])
+		if node.Dirty {
+			attributes = attributes + ", style=filled, fillcolor=\"#ffcccc\""
+		}
+		if node.Cycle {
+			attributes = attributes + ", color=red, penwidth=2"
+		}
+		fmt.Printf("  %q [%s];\n", node.Filename, attributes)
+	}
+	for _, edge := range graph.Edges {
+		fmt.Printf("  %q -> %q [tooltip=%q];\n", edge.From, edge.To, fmt.Sprintf("\\%s on line %d", edge.Command, edge.Line))
+	}
+	fmt.Println("}")
+}
+
+// DisplayGraphTree prints each file which nothing else depends on,
+// with the files it depends on indented beneath it; dirty files are
+// marked with an asterisk, and files on a cycle say so
+func DisplayGraphTree(directory string, graph RepositoryGraph) {
+	graph = graph.relativeTo(directory)
+
+	nodes := make(map[string]GraphNode)
+	children := make(map[string][]GraphEdge)
+	hasParent := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		nodes[node.Filename] = node
+	}
+	for _, edge := range graph.Edges {
+		children[edge.From] = append(children[edge.From], edge)
+		hasParent[edge.To] = true
+	}
+
+	var roots []string
+	for _, node := range graph.Nodes {
+		if !hasParent[node.Filename] {
+			roots = append(roots, node.Filename)
+		}
+	}
+	sort.Strings(roots)
+
+	shown := make(map[string]bool)
+	onPath := make(map[string]bool)
+
+	var display func(filename string, depth int, suffix string)
+	display = func(filename string, depth int, suffix string) {
+		node := nodes[filename]
+		mark := " "
+		if node.Dirty {
+			mark = "*"
+		}
+
+		line := fmt.Sprintf("%s%s %s (%s)%s", strings.Repeat("    ", depth), mark, filename, node.Kind, suffix)
+		if node.Cycle {
+			line = line + " [on a cycle]"
+		}
+
+		if onPath[filename] {
+			fmt.Println(line + " [cycle]")
+			return
+		}
+
+		if shown[filename] && len(children[filename]) > 0 {
+			fmt.Println(line + " [see above]")
+			return
+		}
+
+		fmt.Println(line)
+		shown[filename] = true
+
+		onPath[filename] = true
+		for _, edge := range children[filename] {
+			display(edge.To, depth+1, fmt.Sprintf(" line %d", edge.Line))
+		}
+		onPath[filename] = false
+	}
+
+	for _, root := range roots {
+		display(root, 0, "")
+	}
+
+	// whatever is left lies on a cycle
+	for _, node := range graph.Nodes {
+		if !shown[node.Filename] {
+			display(node.Filename, 0, "")
+		}
+	}
+}
+
+// DisplayGraph prints the repository's dependency graph in the given
+// format, perhaps restricted to the dirty files, or to what can be
+// reached from a file
+func DisplayGraph(directory string, format string, dirtyOnly bool, from string, reverse bool) error {
+	graph, err := BuildRepositoryGraph(directory)
+	if err != nil {
+		return err
+	}
+
+	if from != "" {
+		from, err = filepath.Abs(from)
+		if err != nil {
+			return err
+		}
+		graph = graph.Reachable(from, reverse)
+		if len(graph.Nodes) == 0 {
+			return fmt.Errorf("%s is not in the dependency graph", from)
+		}
+	}
+
+	if dirtyOnly {
+		graph = graph.DirtyOnly()
+	}
+
+	switch format {
+	case "tree":
+		DisplayGraphTree(directory, graph)
+	case "dot":
+		DisplayGraphDot(directory, graph)
+	case "json":
+		return DisplayGraphJson(directory, graph)
+	default:
+		return fmt.Errorf("Unknown graph format %s; try tree, dot, or json", format)
+	}
+
+	return nil
+}
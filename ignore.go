@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Each directory may have a .gitignore and a .xakeignore, both in the
+// syntax of .gitignore; the latter is read second, so it wins
+var ignoreFilenames = []string{".gitignore", ".xakeignore"}
+
+// An ignorePattern is one line of an ignore file
+type ignorePattern struct {
+	filename      string
+	line          int
+	text          string
+	negated       bool
+	directoryOnly bool
+	regexp        *regexp.Regexp
+}
+
+func (pattern ignorePattern) String() string {
+	return fmt.Sprintf("%s:%d: %s", displayName(pattern.filename), pattern.line, pattern.text)
+}
+
+// An IgnoreMatcher decides which paths in a repository are ignored,
+// reading the ignore files in each directory as they are needed
+type IgnoreMatcher struct {
+	root string
+
+	mutex    sync.Mutex
+	patterns map[string][]ignorePattern
+}
+
+// NewIgnoreMatcher reads the ignore files for the repository at root
+func NewIgnoreMatcher(root string) *IgnoreMatcher {
+	return &IgnoreMatcher{root: root, patterns: make(map[string][]ignorePattern)}
+}
+
+// globToRegexp translates the wildcards of a .gitignore pattern
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				// any number of directories, including none
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	return b.String()
+}
+
+// parseIgnorePattern interprets a line of an ignore file, returning
+// false for blank lines and comments
+func parseIgnorePattern(text string) (ignorePattern, bool) {
+	pattern := ignorePattern{text: text}
+
+	// trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\\ ") {
+		text = text[:len(text)-1]
+	}
+
+	if text == "" || strings.HasPrefix(text, "#") {
+		return pattern, false
+	}
+
+	if strings.HasPrefix(text, "!") {
+		pattern.negated = true
+		text = text[1:]
+	} else if strings.HasPrefix(text, "\\!") || strings.HasPrefix(text, "\\#") {
+		text = text[1:]
+	}
+
+	if strings.HasSuffix(text, "/") {
+		pattern.directoryOnly = true
+		text = strings.TrimRight(text, "/")
+	}
+
+	if text == "" {
+		return pattern, false
+	}
+
+	// a pattern with a slash is relative to the ignore file, and any
+	// other matches a name at any depth
+	expression := globToRegexp(strings.TrimPrefix(text, "/"))
+	if !strings.Contains(text, "/") {
+		expression = "(.*/)?" + expression
+	}
+
+	var err error
+	pattern.regexp, err = regexp.Compile("^" + expression + "$")
+	if err != nil {
+		return pattern, false
+	}
+
+	return pattern, true
+}
+
+// load reads the ignore files in directory, relative to the root, if
+// we have not already
+func (matcher *IgnoreMatcher) load(directory string) []ignorePattern {
+	matcher.mutex.Lock()
+	defer matcher.mutex.Unlock()
+
+	if patterns, ok := matcher.patterns[directory]; ok {
+		return patterns
+	}
+
+	var patterns []ignorePattern
+	for _, name := range ignoreFilenames {
+		filename := filepath.Join(matcher.root, filepath.FromSlash(directory), name)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		line := 0
+		for scanner.Scan() {
+			line++
+			pattern, ok := parseIgnorePattern(scanner.Text())
+			if ok {
+				pattern.filename = filename
+				pattern.line = line
+				patterns = append(patterns, pattern)
+			}
+		}
+		f.Close()
+	}
+
+	matcher.patterns[directory] = patterns
+	return patterns
+}
+
+// match decides whether relative (with forward slashes) is ignored by
+// the patterns in its own directory and those above it, the last
+// pattern to match winning
+func (matcher *IgnoreMatcher) match(relative string, isDirectory bool) (bool, *ignorePattern) {
+	var matched *ignorePattern
+
+	components := strings.Split(relative, "/")
+	for depth := 0; depth < len(components); depth++ {
+		directory := strings.Join(components[:depth], "/")
+		below := strings.Join(components[depth:], "/")
+
+		patterns := matcher.load(directory)
+		for i := range patterns {
+			pattern := patterns[i]
+			if pattern.directoryOnly && !isDirectory {
+				continue
+			}
+			if pattern.regexp.MatchString(below) {
+				matched = &pattern
+			}
+		}
+	}
+
+	if matched == nil || matched.negated {
+		return false, nil
+	}
+	return true, matched
+}
+
+// Ignored reports whether path, or a directory containing it, is
+// ignored, and which pattern is responsible
+func (matcher *IgnoreMatcher) Ignored(path string) (bool, *ignorePattern) {
+	relative, err := filepath.Rel(matcher.root, path)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return false, nil
+	}
+
+	components := strings.Split(filepath.ToSlash(relative), "/")
+	for i := 1; i < len(components); i++ {
+		if ignored, pattern := matcher.match(strings.Join(components[:i], "/"), true); ignored {
+			return true, pattern
+		}
+	}
+
+	info, err := os.Stat(path)
+	isDirectory := err == nil && info.IsDir()
+	return matcher.match(strings.Join(components, "/"), isDirectory)
+}
+
+// IgnoredDuringWalk is Ignored for use inside filepath.Walk, which
+// has already skipped any ignored directories above path
+func (matcher *IgnoreMatcher) IgnoredDuringWalk(path string, info os.FileInfo) (bool, *ignorePattern) {
+	relative, err := filepath.Rel(matcher.root, path)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return false, nil
+	}
+
+	return matcher.match(filepath.ToSlash(relative), info != nil && info.IsDir())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnorePattern(t *testing.T) {
+	tests := []struct {
+		text          string
+		ok            bool
+		negated       bool
+		directoryOnly bool
+		matches       []string
+		misses        []string
+	}{
+		{text: "", ok: false},
+		{text: "   ", ok: false},
+		{text: "# a comment", ok: false},
+		{text: "/", ok: false},
+		{text: "*.log", ok: true, matches: []string{"a.log", "dir/a.log", "a/b/c.log"}, misses: []string{"a.log.txt", "log"}},
+		{text: "build", ok: true, matches: []string{"build", "src/build"}, misses: []string{"builder", "build.tex"}},
+		{text: "!keep.log", ok: true, negated: true, matches: []string{"keep.log", "dir/keep.log"}},
+		{text: "/root.tex", ok: true, matches: []string{"root.tex"}, misses: []string{"dir/root.tex"}},
+		{text: "doc/*.pdf", ok: true, matches: []string{"doc/a.pdf"}, misses: []string{"x/doc/a.pdf", "doc/sub/a.pdf"}},
+		{text: "**/figures", ok: true, matches: []string{"figures", "a/figures", "a/b/figures"}, misses: []string{"figures2"}},
+		{text: "drafts/**", ok: true, matches: []string{"drafts/a.tex", "drafts/a/b.tex"}, misses: []string{"drafts", "other/drafts/a.tex"}},
+		{text: "a/**/b", ok: true, matches: []string{"a/b", "a/x/b", "a/x/y/b"}, misses: []string{"a/xb"}},
+		{text: "cache/", ok: true, directoryOnly: true, matches: []string{"cache", "dir/cache"}},
+		{text: "file?.tex", ok: true, matches: []string{"file1.tex"}, misses: []string{"file.tex", "file12.tex"}},
+		{text: "[ab].tex", ok: true, matches: []string{"a.tex", "b.tex"}, misses: []string{"c.tex"}},
+		{text: "[!ab].tex", ok: true, matches: []string{"c.tex"}, misses: []string{"a.tex"}},
+		{text: "\\#hash", ok: true, matches: []string{"#hash"}},
+		{text: "\\!bang", ok: true, matches: []string{"!bang"}},
+		{text: "space\\ ", ok: true, matches: []string{"space "}, misses: []string{"space"}},
+		{text: "trailing   ", ok: true, matches: []string{"trailing"}, misses: []string{"trailing   "}},
+		{text: "a.tex", ok: true, matches: []string{"a.tex"}, misses: []string{"aXtex"}},
+	}
+
+	for _, test := range tests {
+		pattern, ok := parseIgnorePattern(test.text)
+		if ok != test.ok {
+			t.Errorf("parseIgnorePattern(%q) returned %v, expected %v", test.text, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if pattern.negated != test.negated || pattern.directoryOnly != test.directoryOnly {
+			t.Errorf("parseIgnorePattern(%q) is negated %v and directory only %v, expected %v and %v",
+				test.text, pattern.negated, pattern.directoryOnly, test.negated, test.directoryOnly)
+		}
+		for _, path := range test.matches {
+			if !pattern.regexp.MatchString(path) {
+				t.Errorf("%q does not match %q", test.text, path)
+			}
+		}
+		for _, path := range test.misses {
+			if pattern.regexp.MatchString(path) {
+				t.Errorf("%q matches %q", test.text, path)
+			}
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{
+		".gitignore":               "*.log\n!keep.log\n/top.tex\ncache/\nbuild\n",
+		".xakeignore":              "drafts/**\n",
+		"chapter/.gitignore":       "!*.log\nlocal.tex\n",
+		"chapter/.xakeignore":      "local.tex\n!local.tex\n",
+		"a.log":                    "",
+		"keep.log":                 "",
+		"top.tex":                  "",
+		"chapter/top.tex":          "",
+		"chapter/a.log":            "",
+		"chapter/local.tex":        "",
+		"cache/figure.svg":         "",
+		"chapter/cache/figure.svg": "",
+		"notes/cache":              "",
+		"build/output.pdf":         "",
+		"drafts/sketch.tex":        "",
+		"activity.tex":             "",
+	})
+
+	tests := []struct {
+		path    string
+		ignored bool
+		pattern string
+	}{
+		{"a.log", true, ".gitignore:1: *.log"},
+		{"keep.log", false, ""},
+		{"top.tex", true, ".gitignore:3: /top.tex"},
+		{"chapter/top.tex", false, ""},
+		{"chapter/a.log", false, ""},
+		{"chapter/local.tex", false, ""},
+		{"cache", true, ".gitignore:4: cache/"},
+		{"cache/figure.svg", true, ".gitignore:4: cache/"},
+		{"chapter/cache/figure.svg", true, ".gitignore:4: cache/"},
+		{"notes/cache", false, ""},
+		{"build/output.pdf", true, ".gitignore:5: build"},
+		{"drafts/sketch.tex", true, ".xakeignore:1: drafts/**"},
+		{"activity.tex", false, ""},
+		{".", false, ""},
+	}
+
+	matcher := NewIgnoreMatcher(directory)
+	for _, test := range tests {
+		ignored, pattern := matcher.Ignored(filepath.Join(directory, filepath.FromSlash(test.path)))
+		if ignored != test.ignored {
+			t.Errorf("Ignored(%q) = %v, expected %v", test.path, ignored, test.ignored)
+			continue
+		}
+		if pattern == nil {
+			continue
+		}
+
+		relative, _ := filepath.Rel(directory, pattern.filename)
+		description := fmt.Sprintf("%s:%d: %s", filepath.ToSlash(relative), pattern.line, pattern.text)
+		if description != test.pattern {
+			t.Errorf("Ignored(%q) blamed %q, expected %q", test.path, description, test.pattern)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DisplayAffected lists every document in the repository which would
+// need to be compiled if filename changed
+func DisplayAffected(directory string, filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	if !exists(filename) {
+		return fmt.Errorf("%s does not exist", filename)
+	}
+
+	documents, err := TexFilesInRepository(directory)
+	if err != nil {
+		return err
+	}
+
+	affected := AffectedFiles(directory, documents, []string{filename})
+	sort.Strings(affected)
+
+	name := displayName(filename)
+	if len(affected) == 0 {
+		fmt.Printf("Changing %s would not cause anything to be compiled.\n", name)
+		return nil
+	}
+
+	if len(affected) == 1 {
+		fmt.Printf("Changing %s would cause 1 file to be compiled:\n", name)
+	} else {
+		fmt.Printf("Changing %s would cause %d files to be compiled:\n", name, len(affected))
+	}
+	for _, document := range affected {
+		fmt.Printf("    %s\n", displayName(document))
+	}
+
+	return nil
+}
+
+// dependencyChanges lists the differences between the dependencies
+// recorded in htmlFilename and the files in the repository; found is
+// false when none of the recorded dependencies could be checked
+func dependencyChanges(directory string, htmlFilename string) (changes []string, found bool) {
+	recorded, err := RecordedDependencyHashes(htmlFilename)
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for name := range recorded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		hash, err := hashFile(filepath.Join(directory, name))
+		if err != nil {
+			continue
+		}
+		found = true
+
+		if hash != recorded[name] {
+			changes = append(changes, fmt.Sprintf("%s changed (was %.7s, now %.7s)", name, recorded[name], hash))
+		}
+	}
+
+	return
+}
+
+// ExplainStaleness describes why filename is considered dirty, or
+// says that it is not
+func ExplainStaleness(directory string, filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+
+	documents, err := TexFilesInRepository(directory)
+	if err != nil {
+		return err
+	}
+
+	name := displayName(filename)
+	if !stringInSlice(filename, documents) {
+		return fmt.Errorf("%s is not a document committed to the repository", name)
+	}
+
+	plan, err := PlanCompilation(documents)
+	if err != nil {
+		return err
+	}
+
+	var planned *PlannedCompilation
+	position := 0
+	for i, compilation := range plan.Compilations {
+		if compilation.Filename == filename {
+			planned = &plan.Compilations[i]
+			position = i + 1
+		}
+	}
+
+	if planned == nil {
+		fmt.Printf("%s is up to date.\n", name)
+		return nil
+	}
+
+	fmt.Printf("%s needs to be compiled (it is number %d of %d):\n", name, position, len(plan.Compilations))
+
+	htmlFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+	state := CurrentBuildState(directory)
+	if changes, known := state.Changes(directory, filename, htmlFilename); known {
+		for _, change := range changes {
+			fmt.Printf("    %s\n", change)
+		}
+	} else if _, err := os.Stat(htmlFilename); err != nil {
+		fmt.Printf("    %s is missing\n", displayName(htmlFilename))
+	} else if changes, found := dependencyChanges(directory, htmlFilename); found {
+		toolchain, _ := RecordedToolchain(htmlFilename)
+		changes = append(changes, ToolchainChanges(filename, "", toolchain)...)
+		for _, change := range changes {
+			fmt.Printf("    %s\n", change)
+		}
+	} else {
+		fmt.Printf("    %s records no dependencies, so modification times were compared instead\n", displayName(htmlFilename))
+		for _, reason := range planned.Reasons {
+			if !strings.HasPrefix(reason, propagatedReason) {
+				fmt.Printf("    %s\n", reason)
+			}
+		}
+	}
+
+	for _, reason := range planned.Reasons {
+		if strings.HasPrefix(reason, propagatedReason) {
+			fmt.Printf("    %s\n", reason)
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/fatih/color"
 	prefixed "github.com/kisonecat/logrus-prefixed-formatter"
@@ -9,8 +10,12 @@ import (
 	"github.com/urfave/cli"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var log = logrus.New()
@@ -26,6 +31,27 @@ func init() {
 	log.Formatter = formatter
 }
 
+// interruptibleContext is cancelled when the user presses Ctrl-C,
+// which stops any running TeX or sage process
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			log.Warn("Interrupted, so stopping everything that is running.")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
+
 func main() {
 	var group sync.WaitGroup
 
@@ -123,6 +149,18 @@ COPYRIGHT:
 			Value: 2,
 			Usage: "The number of processes to run in parallel",
 		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Compile everything rather than reusing cached builds",
+		},
+		cli.StringFlag{
+			Name:  "cache-url",
+			Usage: "Share compiled files through the cache server at `URL`",
+		},
+		cli.StringFlag{
+			Name:  "timeout, T",
+			Usage: "Stop any compilation step which runs for longer than `DURATION`",
+		},
 		cli.StringFlag{
 			Name:  "repository, r",
 			Value: repository,
@@ -147,9 +185,18 @@ COPYRIGHT:
 			Usage:   "compile a .tex file into an .html file",
 			Action: func(c *cli.Context) error {
 				filename := c.Args().Get(0)
-				log.Info("Compiling " + filename + " in .")
-				_, err := Compile(".", filename)
+				log.Info("Compiling " + filename + " in " + repository)
+				ctx, cancel := interruptibleContext()
+				defer cancel()
+				// the file's inputs may lie anywhere in the repository,
+				// not just beneath the working directory
+				absolute, err := filepath.Abs(filename)
+				if err == nil {
+					_, err = Compile(ctx, repository, absolute)
+				}
+				FlushBuildStates()
 				if err != nil {
+					DisplayCompileError(err)
 					log.Error("Could not compile " + filename)
 					os.Exit(1)
 				}
@@ -210,8 +257,140 @@ COPYRIGHT:
 			// I have so much trouble typing this word
 			Aliases: []string{"b", "abke", "beak", "beka", "bkae", "bkea", "eabk", "eakb", "ebak", "ebka", "ekab", "ekba", "kabe", "kaeb", "kbae", "kbea", "keab", "keba"},
 			Usage:   "compile all the files in the repository",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "List what would be compiled, and why, without compiling anything",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "With --dry-run, describe the plan in JSON",
+				},
+				cli.BoolFlag{
+					Name:  "toolchain-changed",
+					Usage: "Also compile files which do not record the toolchain which compiled them",
+				},
+				cli.BoolFlag{
+					Name:  "keep-going, k",
+					Usage: "After a file fails, keep compiling the files which do not depend on it",
+				},
+				cli.StringFlag{
+					Name:  "rev",
+					Usage: "Compile `COMMIT` in a worktree, rather than the working copy",
+				},
+				cli.BoolFlag{
+					Name:  "staged",
+					Usage: "Compile what is staged in the index in a worktree, rather than the working copy",
+				},
+				cli.StringFlag{
+					Name:  "report-json",
+					Usage: "Write a report on each file, with timings and diagnostics, as JSON to `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "report-junit",
+					Usage: "Write a report on each file as JUnit XML to `FILE`, for CI systems",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				assumeToolchainChanged = c.Bool("toolchain-changed")
+				started := time.Now()
+
+				// a worktree changes the working directory, but reports
+				// are still written where we were asked
+				jsonReport, junitReport := c.String("report-json"), c.String("report-junit")
+				for _, filename := range []*string{&jsonReport, &junitReport} {
+					if *filename != "" {
+						absolute, err := filepath.Abs(*filename)
+						if err != nil {
+							log.Error(err)
+							os.Exit(1)
+						}
+						*filename = absolute
+					}
+				}
+
+				worktree, commit := "", ""
+				if c.String("rev") != "" || c.Bool("staged") {
+					if c.String("rev") != "" && c.Bool("staged") {
+						log.Error("Use either --rev or --staged, but not both")
+						os.Exit(1)
+					}
+
+					var err error
+					worktree, commit, err = EnterWorktree(c.String("rev"), c.Bool("staged"))
+					if err != nil {
+						log.Error(err)
+						os.Exit(1)
+					}
+				}
+
+				if c.Bool("dry-run") || c.Bool("json") {
+					err := DryRunBake(c.Bool("json"))
+					if err != nil {
+						log.Error(err)
+						os.Exit(1)
+					}
+					return nil
+				}
+
+				ctx, cancel := interruptibleContext()
+				defer cancel()
+				reports, err := Bake(ctx, workers, c.Bool("keep-going"))
+
+				report := NewBuildReport(repository, app.Version, started, reports)
+				if jsonReport != "" {
+					if reportErr := WriteJsonReport(jsonReport, report); reportErr != nil {
+						log.Error(reportErr)
+					}
+				}
+				if junitReport != "" {
+					if reportErr := WriteJunitReport(junitReport, report); reportErr != nil {
+						log.Error(reportErr)
+					}
+				}
+
+				if err != nil {
+					log.Error(err)
+					os.Exit(1)
+				}
+				if worktree != "" {
+					DisplayWorktreeInstructions(worktree, commit)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "watch",
+			Aliases: []string{"w"},
+			Usage:   "compile files in the repository whenever they change",
+			Action: func(c *cli.Context) error {
+				ctx, cancel := interruptibleContext()
+				defer cancel()
+				err := Watch(ctx, workers, repository, nil)
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			},
+		},
+		{
+			Name:  "preview",
+			Usage: "serve the compiled files locally, reloading them as they change",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "localhost:8000",
+					Usage: "Listen for connections on `ADDRESS`",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				return Bake(workers)
+				ctx, cancel := interruptibleContext()
+				defer cancel()
+				err := Preview(ctx, workers, repository, c.String("listen"))
+				if err != nil {
+					log.Error(err)
+				}
+				return err
 			},
 		},
 		{
@@ -313,6 +492,162 @@ COPYRIGHT:
 			},
 		},
 
+		{
+			Name:  "cache",
+			Usage: "manage the cache of compiled files",
+			Subcommands: []cli.Command{
+				{
+					Name:  "stats",
+					Usage: "describe what is in the cache",
+					Action: func(c *cli.Context) error {
+						err := DisplayBuildCacheStatistics()
+						if err != nil {
+							log.Error(err)
+						}
+						return err
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "remove old builds from the cache",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "older-than",
+							Value: "720h",
+							Usage: "Remove builds which have not been used for `DURATION`",
+						},
+						cli.StringFlag{
+							Name:  "max-size",
+							Usage: "Then remove the least recently used builds until the cache fits in `SIZE` (e.g., 500M)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						maximumAge, err := time.ParseDuration(c.String("older-than"))
+						if err != nil {
+							log.Error(err)
+							return err
+						}
+
+						var maximumSize int64
+						if c.String("max-size") != "" {
+							maximumSize, err = parseSize(c.String("max-size"))
+							if err != nil {
+								log.Error(err)
+								return err
+							}
+						}
+
+						err = PruneBuildCache(maximumAge, maximumSize)
+						if err != nil {
+							log.Error(err)
+						}
+						return err
+					},
+				},
+			},
+		},
+
+		{
+			Name:  "cache-server",
+			Usage: "share a cache of compiled files over HTTP",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Value: ":8080",
+					Usage: "Listen for connections on `ADDRESS`",
+				},
+				cli.StringFlag{
+					Name:  "directory",
+					Usage: "Store the cache in `PATH` (by default, the local build cache)",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					EnvVar: "XAKE_CACHE_TOKEN",
+					Usage:  "Accept uploads which present `TOKEN` (without one, refuse uploads)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				directory := c.String("directory")
+				if directory == "" {
+					var err error
+					directory, err = buildCacheDirectory()
+					if err != nil {
+						log.Error(err)
+						return err
+					}
+				}
+
+				err := CacheServer(c.String("listen"), directory, c.String("token"))
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			},
+		},
+
+		{
+			Name:  "graph",
+			Usage: "display the dependency graph of the repository",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "tree",
+					Usage: "Display the graph as a `FORMAT` (tree, dot, or json)",
+				},
+				cli.BoolFlag{
+					Name:  "dirty",
+					Usage: "Display only the files which need compiling or have changed",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Display only what `FILE` depends on",
+				},
+				cli.BoolFlag{
+					Name:  "reverse",
+					Usage: "With --from, display what depends on the file instead",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				err := DisplayGraph(repository, c.String("format"), c.Bool("dirty"), c.String("from"), c.Bool("reverse"))
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			},
+		},
+
+		{
+			Name:      "affected",
+			Usage:     "list the files which would be compiled if a file changed",
+			ArgsUsage: "FILE",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.ShowCommandHelp(c, "affected")
+				}
+				err := DisplayAffected(repository, c.Args().Get(0))
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			},
+		},
+
+		{
+			Name:      "why",
+			Usage:     "explain why a .tex file needs to be compiled",
+			ArgsUsage: "FILE.tex",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.ShowCommandHelp(c, "why")
+				}
+				err := ExplainStaleness(repository, c.Args().Get(0))
+				if err != nil {
+					log.Error(err)
+				}
+				return err
+			},
+		},
+
 		{
 			Name:    "view",
 			Hidden:  true,
@@ -329,14 +664,22 @@ COPYRIGHT:
 			Aliases: []string{"i", "info"},
 			Usage:   "display information about the repository",
 			Action: func(c *cli.Context) error {
-				files, _, err := NeedingCompilation(repository)
+				filenames, skipped, err := ScanRepository(repository, IsTexDocument)
 				if err != nil {
 					log.Error(err)
-					return err
+					os.Exit(1)
+				}
+				files, _, err := NeedingCompilationAmong(filenames)
+				if err != nil {
+					log.Error(err)
+					os.Exit(1)
 				}
 				for _, file := range files {
 					log.Warn(fmt.Sprintf("%s needs to be compiled", file))
 				}
+				for _, file := range skipped {
+					log.Info(fmt.Sprintf("Skipped %s, which is %s", displayName(file.Filename), file.Reason))
+				}
 				return nil
 			},
 		},
@@ -356,6 +699,18 @@ COPYRIGHT:
 			workers = 2
 		}
 
+		if c.Bool("no-cache") {
+			useBuildCache = false
+		}
+
+		if c.String("timeout") != "" {
+			timeout, err := time.ParseDuration(c.String("timeout"))
+			if err != nil {
+				return err
+			}
+			stepTimeout = timeout
+		}
+
 		if c.Bool("no-color") {
 			color.NoColor = true
 			plainLogs := new(prefixed.TextFormatter)
@@ -364,13 +719,27 @@ COPYRIGHT:
 			log.Formatter = plainLogs
 		}
 
-		repository = c.String("repository")
-		repository, err := FindRepositoryAmongParentDirectories(repository)
+		// every command works on the one repository resolved here
+		directory, err := filepath.Abs(c.String("repository"))
+		if err != nil {
+			return err
+		}
+		repository, err = FindRepositoryAmongParentDirectories(directory)
 		if err != nil {
 			return err
 		}
 		log.Debug("Using repository " + repository)
 
+		err = LoadConfiguration(repository)
+		if err != nil {
+			return err
+		}
+
+		remoteCacheUrl = configuration.CacheUrl
+		if c.String("cache-url") != "" {
+			remoteCacheUrl = c.String("cache-url")
+		}
+
 		keyFingerprint = c.String("key")
 		// Failing to be able to resolve the key is not a fatal error,
 		// because you don't necessarily need to have GPG installed in
@@ -423,6 +792,7 @@ COPYRIGHT:
 	sort.Sort(cli.CommandsByName(app.Commands))
 
 	app.Run(os.Args)
+	FlushBuildStates()
 
 	group.Wait()
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stevenle/topsort"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A PlannedCompilation records why a file is going to be compiled
+// and which files must be compiled before it
+type PlannedCompilation struct {
+	Filename     string   `json:"filename"`
+	Reasons      []string `json:"reasons"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// A BuildPlan lists the files needing compilation, in an order which
+// compiles dependencies first
+type BuildPlan struct {
+	Compilations []PlannedCompilation `json:"compilations"`
+}
+
+// Files lists the files in the plan, in order
+func (plan BuildPlan) Files() []string {
+	var files []string
+	for _, compilation := range plan.Compilations {
+		files = append(files, compilation.Filename)
+	}
+	return files
+}
+
+// DependencyGraph maps each file in the plan to the files in the plan
+// which must be compiled before it
+func (plan BuildPlan) DependencyGraph() map[string][]string {
+	graph := make(map[string][]string)
+	for _, compilation := range plan.Compilations {
+		if len(compilation.Dependencies) > 0 {
+			graph[compilation.Filename] = compilation.Dependencies
+		}
+	}
+	return graph
+}
+
+// Files which are dirty only because they depend on dirty files have
+// reasons beginning with propagatedReason
+const propagatedReason = "it depends on "
+
+// staleDocuments decides which of the given files are dirty, and why:
+// because they changed, or because they depend on a file which is
+// dirty.  Unlike PlanCompilation, it works on files which depend on
+// one another in a cycle.
+func staleDocuments(filenames []string) (map[string]bool, map[string][]string) {
+	dirty := make(map[string]bool)
+	reasons := make(map[string][]string)
+
+	log.Debug("Determine if file are up-to-date.")
+	state := CurrentBuildState(repository)
+	for _, filename := range filenames {
+		// the build state is cheaper to consult than the .html files,
+		// which we only read when the state knows nothing
+		outputFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+		reason, known := state.Staleness(repository, filename, outputFilename)
+		if !known {
+			var err error
+			reason, err = Staleness(filename, outputFilename)
+			if err != nil {
+				reason = "could not be checked: " + err.Error()
+			}
+		}
+
+		if reason == "" && assumeToolchainChanged && !state.HasRecordedToolchain(repository, filename) {
+			if recorded, _ := RecordedToolchain(outputFilename); len(recorded) == 0 {
+				reason = "it does not record which toolchain compiled it"
+			}
+		}
+
+		if reason != "" {
+			dirty[filename] = true
+			reasons[filename] = append(reasons[filename], reason)
+		}
+	}
+
+	log.Debug("Propagate dirt across dependencies.")
+	for {
+		dirtMoving := false
+
+		for _, filename := range filenames {
+			if !dirty[filename] {
+				dependencies, err := LatexDependencies(filename)
+				if err == nil {
+					for _, dependency := range dependencies {
+						if dirty[dependency] {
+							dirty[filename] = true
+							dirtMoving = true
+							reasons[filename] = append(reasons[filename], propagatedReason+filepath.Base(dependency)+", which needs compiling")
+						}
+					}
+				}
+			}
+		}
+
+		if !dirtMoving {
+			break
+		}
+	}
+
+	return dirty, reasons
+}
+
+// PlanCompilation decides which of the given files need to be
+// compiled, and why; dependencies outside of filenames are treated as
+// clean
+func PlanCompilation(filenames []string) (BuildPlan, error) {
+	var plan BuildPlan
+	graph := topsort.NewGraph()
+	dependencyGraph := make(map[string][]string)
+
+	log.Debug("Look for cycles of dependencies.")
+	if cycle := FindDependencyCycle(filenames); cycle != nil {
+		return plan, cycle
+	}
+
+	dirty, reasons := staleDocuments(filenames)
+
+	log.Debug("Build dependency graph.")
+	for _, filename := range filenames {
+		graph.AddNode(filename)
+	}
+	for _, filename := range filenames {
+		if dirty[filename] {
+			dependencies, err := LatexDependencies(filename)
+			if err == nil {
+				for _, dependency := range dependencies {
+					graph.AddEdge(filename, dependency)
+					if dirty[dependency] {
+						dependencyGraph[filename] = append(dependencyGraph[filename], dependency)
+					}
+				}
+			}
+		}
+	}
+
+	log.Debug("Perform topological sort on dependencies.")
+	added := make(map[string]bool)
+	for _, filename := range filenames {
+		if dirty[filename] {
+			sorted, err := graph.TopSort(filename)
+			if err != nil {
+				return plan, err
+			}
+
+			for _, orderedName := range sorted {
+				if dirty[orderedName] {
+					if !added[orderedName] {
+						plan.Compilations = append(plan.Compilations, PlannedCompilation{
+							Filename:     orderedName,
+							Reasons:      reasons[orderedName],
+							Dependencies: dependencyGraph[orderedName],
+						})
+						added[orderedName] = true
+					}
+				}
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// relativePlan names the files in the plan relative to directory
+func relativePlan(directory string, plan BuildPlan) BuildPlan {
+	relative := func(filename string) string {
+		rel, err := filepath.Rel(directory, filename)
+		if err != nil {
+			return filename
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	var result BuildPlan
+	result.Compilations = []PlannedCompilation{}
+	for _, compilation := range plan.Compilations {
+		planned := PlannedCompilation{
+			Filename:     relative(compilation.Filename),
+			Reasons:      append([]string{}, compilation.Reasons...),
+			Dependencies: []string{},
+		}
+		for _, dependency := range compilation.Dependencies {
+			planned.Dependencies = append(planned.Dependencies, relative(dependency))
+		}
+		result.Compilations = append(result.Compilations, planned)
+	}
+
+	return result
+}
+
+// DisplayBuildPlan describes what bake would do
+func DisplayBuildPlan(directory string, plan BuildPlan) {
+	plan = relativePlan(directory, plan)
+
+	if len(plan.Compilations) == 0 {
+		fmt.Println("Everything is up to date.")
+		return
+	}
+
+	fmt.Printf("Would compile %d files:\n", len(plan.Compilations))
+	for i, compilation := range plan.Compilations {
+		fmt.Printf("%4d. %s\n", i+1, compilation.Filename)
+		for _, reason := range compilation.Reasons {
+			fmt.Printf("        because %s\n", reason)
+		}
+		if len(compilation.Dependencies) > 0 {
+			fmt.Printf("        after %s\n", strings.Join(compilation.Dependencies, ", "))
+		}
+	}
+}
+
+// DisplayBuildPlanJson describes what bake would do in JSON
+func DisplayBuildPlanJson(directory string, plan BuildPlan) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(relativePlan(directory, plan))
+}
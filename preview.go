@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The preview injects this into every page, so that the page reloads
+// itself when it (or, for a xourse, anything) is recompiled
+const previewScript = `
+<script>
+(function() {
+  var page = location.pathname.replace(/^\/+/, "").replace(/\.html$/, "");
+  var xourse = document.querySelector('meta[name="description"][content="xourse"]') !== null;
+  var events = new EventSource("/_xake/events");
+  events.onmessage = function(event) {
+    if (xourse || event.data === page) {
+      location.reload();
+    }
+  };
+})();
+</script>
+<script>
+window.MathJax = { tex: { inlineMath: [["\\(", "\\)"]] } };
+</script>
+<script async src="https://cdn.jsdelivr.net/npm/mathjax@3/es5/tex-chtml.js"></script>
+<style>
+body { max-width: 50em; margin: 2em auto; font-family: sans-serif; }
+a.activity { display: block; margin: 1em 0; padding: 0.5em 1em; border: 1px solid #ccc; border-radius: 4px; color: inherit; text-decoration: none; }
+a.activity:hover { border-color: #888; }
+a.activity h2 { margin: 0.2em 0; font-size: 1.2em; }
+a.activity h3 { margin: 0.2em 0; font-size: 1em; font-weight: normal; color: #555; }
+</style>
+`
+
+var previewIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>xake preview</title>
+</head>
+<body>
+<h1>Xourses</h1>
+<ul>
+{{range .Xourses}}<li><a href="/{{.Path}}">{{.Title}}</a></li>
+{{else}}<li>No xourses have been compiled.</li>
+{{end}}</ul>
+<h1>Activities</h1>
+<ul>
+{{range .Activities}}<li><a href="/{{.Path}}">{{.Path}}</a></li>
+{{else}}<li>Nothing has been compiled yet.</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// Images may be referred to without their extension, as they are by
+// \includegraphics
+var previewImageExtensions = []string{".svg", ".png", ".jpg", ".jpeg", ".gif"}
+
+// A reloadBroadcaster tells each open page when a file is recompiled
+type reloadBroadcaster struct {
+	mutex    sync.Mutex
+	channels map[chan string]bool
+}
+
+func (b *reloadBroadcaster) subscribe() chan string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	channel := make(chan string, 16)
+	b.channels[channel] = true
+	return channel
+}
+
+func (b *reloadBroadcaster) unsubscribe(channel chan string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.channels, channel)
+}
+
+func (b *reloadBroadcaster) broadcast(page string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for channel := range b.channels {
+		select {
+		case channel <- page:
+		default:
+			// a page which is not keeping up will miss a reload
+		}
+	}
+}
+
+// serveEvents streams reloads to a page as server-sent events
+func (b *reloadBroadcaster) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	channel := b.subscribe()
+	defer b.unsubscribe(channel)
+
+	for {
+		select {
+		case page := <-channel:
+			fmt.Fprintf(w, "data: %s\n\n", page)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// servePreviewHtml serves a compiled file with the live reload script
+// added and, for a xourse, with its activity links made absolute
+func servePreviewHtml(w http.ResponseWriter, htmlFilename string) {
+	f, err := os.Open(htmlFilename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if isXourseDocument(htmlFilename, doc) {
+		// transformXourse made these relative to the repository root
+		doc.Find("a.activity").Each(func(_ int, s *goquery.Selection) {
+			href, exists := s.Attr("href")
+			if exists && !strings.HasPrefix(href, "/") && !strings.Contains(href, "://") {
+				s.SetAttr("href", "/"+href)
+			}
+		})
+	}
+
+	doc.Find("head").AppendHtml(previewScript)
+
+	html, err := doc.Html()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(html))
+}
+
+type previewLink struct {
+	Path  string
+	Title string
+}
+
+// servePreviewIndex lists the xourses and the compiled activities
+func servePreviewIndex(w http.ResponseWriter, directory string) {
+	xourses, err := FindXoursesInRepository(directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filenames, err := TexFilesInRepository(directory)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var page struct {
+		Xourses    []previewLink
+		Activities []previewLink
+	}
+
+	for name, metadata := range xourses {
+		title := metadata["title"]
+		if title == "" {
+			title = name
+		}
+		page.Xourses = append(page.Xourses, previewLink{Path: filepath.ToSlash(name), Title: title})
+	}
+	sort.Slice(page.Xourses, func(i, j int) bool {
+		return page.Xourses[i].Path < page.Xourses[j].Path
+	})
+
+	for _, filename := range filenames {
+		name := strings.TrimSuffix(filename, filepath.Ext(filename))
+		rel, err := filepath.Rel(directory, name)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := xourses[rel]; ok {
+			continue
+		}
+
+		if exists(name + ".html") {
+			page.Activities = append(page.Activities, previewLink{Path: filepath.ToSlash(rel)})
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = previewIndexTemplate.Execute(&buffer, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
+
+// previewHandler serves the repository much as the Ximera server
+// would: /path/to/activity is path/to/activity.html
+func previewHandler(directory string, broadcaster *reloadBroadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+
+		if name == "/_xake/events" {
+			broadcaster.serveEvents(w, r)
+			return
+		}
+
+		if name == "/" {
+			servePreviewIndex(w, directory)
+			return
+		}
+
+		// Never serve .git, .xake.json, and the like
+		for _, component := range strings.Split(name, "/") {
+			if strings.HasPrefix(component, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		filename := filepath.Join(directory, filepath.FromSlash(name))
+
+		if filepath.Ext(filename) == ".html" && exists(filename) {
+			servePreviewHtml(w, filename)
+			return
+		}
+
+		if exists(filename + ".html") {
+			servePreviewHtml(w, filename+".html")
+			return
+		}
+
+		info, err := os.Stat(filename)
+		if err == nil && !info.IsDir() {
+			http.ServeFile(w, r, filename)
+			return
+		}
+
+		for _, extension := range previewImageExtensions {
+			if exists(filename + extension) {
+				http.ServeFile(w, r, filename+extension)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+	}
+}
+
+// Preview serves the compiled files in the repository on address,
+// and watches the repository, reloading pages in the browser as
+// they are recompiled.
+func Preview(ctx context.Context, workers int, directory string, address string) error {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+
+	broadcaster := &reloadBroadcaster{channels: make(map[chan string]bool)}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: previewHandler(directory, broadcaster)}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+	defer server.Close()
+
+	log.Info("Previewing " + directory + " at http://" + listener.Addr().String() + "/")
+
+	return Watch(ctx, workers, directory, func(filename string) {
+		rel, err := filepath.Rel(directory, strings.TrimSuffix(filename, filepath.Ext(filename)))
+		if err == nil {
+			broadcaster.broadcast(filepath.ToSlash(rel))
+		}
+	})
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func startInProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// killProcessGroup asks taskkill to end the whole tree of processes
+// rooted at the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
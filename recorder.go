@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseRecorderFile reads the .fls file which TeX writes when run
+// with -recorder, and returns the absolute paths of the files it read
+// (but did not also write, as it does the .aux file)
+func parseRecorderFile(flsFilename string) ([]string, error) {
+	var inputs []string
+
+	f, err := os.Open(flsFilename)
+	if err != nil {
+		return inputs, err
+	}
+	defer f.Close()
+
+	pwd := filepath.Dir(flsFilename)
+	var read []string
+	written := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "PWD ") {
+			pwd = strings.TrimPrefix(line, "PWD ")
+			continue
+		}
+
+		var path string
+		isInput := strings.HasPrefix(line, "INPUT ")
+		if isInput {
+			path = strings.TrimPrefix(line, "INPUT ")
+		} else if strings.HasPrefix(line, "OUTPUT ") {
+			path = strings.TrimPrefix(line, "OUTPUT ")
+		} else {
+			continue
+		}
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(pwd, path)
+		}
+		path = filepath.Clean(path)
+
+		if isInput {
+			read = append(read, path)
+		} else {
+			written[path] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return inputs, err
+	}
+
+	seen := make(map[string]bool)
+	for _, path := range read {
+		if !written[path] && !seen[path] {
+			seen[path] = true
+			inputs = append(inputs, path)
+		}
+	}
+
+	return inputs, nil
+}
+
+// recordedInputs lists the files in the repository which TeX
+// recorded reading while compiling in the scratch directory
+func (scratch *scratchDirectory) recordedInputs() ([]string, error) {
+	var inputs []string
+
+	flsFilename := strings.TrimSuffix(scratch.scratchFilename, filepath.Ext(scratch.scratchFilename)) + ".fls"
+	paths, err := parseRecorderFile(flsFilename)
+	if err != nil {
+		return inputs, err
+	}
+
+	// TeX may report the scratch directory by its real path, e.g.,
+	// /private/var rather than /var on macOS
+	roots := []string{scratch.root}
+	if root, err := filepath.EvalSymlinks(scratch.root); err == nil && root != scratch.root {
+		roots = append(roots, root)
+	}
+
+	for _, path := range paths {
+		for _, root := range roots {
+			relative, err := filepath.Rel(root, path)
+			if err != nil || strings.HasPrefix(relative, "..") {
+				continue
+			}
+
+			filename := filepath.Join(scratch.repository, relative)
+			if filename == scratch.filename || isDeletable(filename) {
+				break
+			}
+
+			info, err := os.Stat(filename)
+			if err == nil && info.Mode().IsRegular() {
+				inputs = append(inputs, filename)
+			}
+			break
+		}
+	}
+
+	return inputs, nil
+}
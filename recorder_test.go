@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRecorderFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	tests := []struct {
+		name   string
+		fls    string
+		inputs []string
+	}{
+		{
+			name:   "absolute inputs",
+			fls:    "PWD /work\nINPUT /usr/share/texmf/tex/latex/base/article.cls\nINPUT /work/activity.tex\n",
+			inputs: []string{"/usr/share/texmf/tex/latex/base/article.cls", "/work/activity.tex"},
+		},
+		{
+			name:   "relative inputs",
+			fls:    "PWD /work\nINPUT ./activity.tex\nINPUT images/../figures/cat.png\n",
+			inputs: []string{"/work/activity.tex", "/work/figures/cat.png"},
+		},
+		{
+			name:   "written files",
+			fls:    "PWD /work\nINPUT activity.aux\nOUTPUT activity.aux\nOUTPUT activity.pdf\nINPUT activity.tex\n",
+			inputs: []string{"/work/activity.tex"},
+		},
+		{
+			name:   "duplicates",
+			fls:    "PWD /work\nINPUT activity.tex\nINPUT /work/activity.tex\nINPUT macros.sty\nINPUT activity.tex\n",
+			inputs: []string{"/work/activity.tex", "/work/macros.sty"},
+		},
+		{
+			name:   "without PWD",
+			fls:    "INPUT activity.tex\n",
+			inputs: []string{filepath.Join(directory, "activity.tex")},
+		},
+		{
+			name:   "other lines",
+			fls:    "\nsomething else\nINPUT\nPWD /work\nINPUT a.tex\n",
+			inputs: []string{"/work/a.tex"},
+		},
+		{
+			name:   "empty",
+			fls:    "",
+			inputs: nil,
+		},
+	}
+
+	flsFilename := filepath.Join(directory, "activity.fls")
+	for _, test := range tests {
+		if err := ioutil.WriteFile(flsFilename, []byte(test.fls), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		inputs, err := parseRecorderFile(flsFilename)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(inputs, test.inputs) {
+			t.Errorf("%s: parseRecorderFile found %q, expected %q", test.name, inputs, test.inputs)
+		}
+	}
+
+	if _, err := parseRecorderFile(filepath.Join(directory, "missing.fls")); err == nil {
+		t.Errorf("parseRecorderFile read a missing file without an error")
+	}
+}
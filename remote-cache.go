@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteCacheUrl is set by --cache-url or by "cacheUrl" in .xake.json
+var remoteCacheUrl string
+
+// remoteCacheToken, from $XAKE_CACHE_TOKEN, is sent with uploads
+var remoteCacheToken = os.Getenv("XAKE_CACHE_TOKEN")
+
+// After the remote cache fails once, we stop bothering it for the
+// rest of the run
+var remoteCacheDisabled bool
+var remoteCacheMutex sync.Mutex
+
+var remoteCacheClient = &http.Client{Timeout: 15 * time.Second}
+
+var cacheKeyPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+func isRemoteCacheAvailable() bool {
+	remoteCacheMutex.Lock()
+	defer remoteCacheMutex.Unlock()
+
+	return remoteCacheUrl != "" && !remoteCacheDisabled
+}
+
+// giveUpOnRemoteCache warns (only once) that the remote cache is not
+// working, and carries on without it
+func giveUpOnRemoteCache(err error) {
+	remoteCacheMutex.Lock()
+	defer remoteCacheMutex.Unlock()
+
+	if !remoteCacheDisabled {
+		log.Warn("The cache at " + remoteCacheUrl + " is not working, so we will continue without it.")
+		log.Warn(err)
+		remoteCacheDisabled = true
+	}
+}
+
+func remoteCacheEntryUrl(key string) string {
+	return strings.TrimSuffix(remoteCacheUrl, "/") + "/" + key + ".tar.gz"
+}
+
+// fetchFromRemoteCache downloads the build with the given key into
+// the local cache at path, and reports whether the remote had it
+func fetchFromRemoteCache(key string, path string) bool {
+	if !isRemoteCacheAvailable() {
+		return false
+	}
+
+	response, err := remoteCacheClient.Get(remoteCacheEntryUrl(key))
+	if err != nil {
+		giveUpOnRemoteCache(err)
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false
+	}
+
+	if response.StatusCode != http.StatusOK {
+		giveUpOnRemoteCache(fmt.Errorf("GET %s returned %s", remoteCacheEntryUrl(key), response.Status))
+		return false
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "incoming-")
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, response.Body)
+	f.Close()
+	if err != nil {
+		giveUpOnRemoteCache(err)
+		return false
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+
+	log.Debug("Fetched " + key + " from " + remoteCacheUrl)
+	return true
+}
+
+// uploadToRemoteCache shares the build saved at path
+func uploadToRemoteCache(key string, path string) {
+	if !isRemoteCacheAvailable() {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	req, err := http.NewRequest("PUT", remoteCacheEntryUrl(key), f)
+	if err != nil {
+		giveUpOnRemoteCache(err)
+		return
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	if remoteCacheToken != "" {
+		req.Header.Set("Authorization", "Bearer "+remoteCacheToken)
+	}
+
+	response, err := remoteCacheClient.Do(req)
+	if err != nil {
+		giveUpOnRemoteCache(err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		// someone else uploaded the same build first
+		log.Debug(key + " is already in " + remoteCacheUrl)
+		return
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		giveUpOnRemoteCache(fmt.Errorf("PUT %s returned %s", remoteCacheEntryUrl(key), response.Status))
+		return
+	}
+
+	log.Debug("Uploaded " + key + " to " + remoteCacheUrl)
+}
+
+// errCacheEntryExists means an upload would replace a stored build
+var errCacheEntryExists = errors.New("already stored")
+
+// CacheServer shares the builds stored in directory with anyone who
+// asks; uploads must present token as a bearer token, and without a
+// token the cache is read-only.  A stored build is never replaced.
+func CacheServer(address string, directory string, token string) error {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		log.Warn("No --token was given, so the cache will refuse uploads.")
+	}
+
+	log.Info("Serving the build cache in " + directory + " on " + address)
+	return http.ListenAndServe(address, cacheServerHandler(directory, token))
+}
+
+// cacheServerHandler answers the requests made of CacheServer
+func cacheServerHandler(directory string, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".tar.gz")
+		if !cacheKeyPattern.MatchString(key) {
+			http.NotFound(w, r)
+			return
+		}
+
+		path := filepath.Join(directory, key[0:2], key+".tar.gz")
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if !exists(path) {
+				http.NotFound(w, r)
+				return
+			}
+			log.Debug(r.Method + " " + key)
+			http.ServeFile(w, r, path)
+
+		case "PUT":
+			if token == "" {
+				http.Error(w, "Uploads are disabled", http.StatusForbidden)
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			err := receiveCacheEntry(r.Body, path)
+			if err == errCacheEntryExists {
+				http.Error(w, key+" is already stored", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				log.Error(err)
+				http.Error(w, "Could not store "+key, http.StatusInternalServerError)
+				return
+			}
+			log.Info("Stored " + key)
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// receiveCacheEntry writes an uploaded build beside its final
+// location and then links it into place, unless a build with the same
+// key got there first
+func receiveCacheEntry(body io.Reader, path string) error {
+	if exists(path) {
+		return errCacheEntryExists
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	written, err := io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if written == 0 {
+		return errors.New("Refusing to store an empty build")
+	}
+
+	// unlike a rename, a link fails when two uploads race
+	err = os.Link(f.Name(), path)
+	if err != nil && exists(path) {
+		return errCacheEntryExists
+	}
+	return err
+}
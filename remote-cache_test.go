@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheServerHandler(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	key := strings.Repeat("ab", 20)
+	other := strings.Repeat("cd", 20)
+
+	request := func(handler http.Handler, method string, key string, token string, body string) int {
+		r := httptest.NewRequest(method, "/"+key+".tar.gz", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	readOnly := cacheServerHandler(directory, "")
+	writable := cacheServerHandler(directory, "secret")
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		key     string
+		token   string
+		body    string
+		status  int
+	}{
+		{"upload without a token configured", readOnly, "PUT", key, "", "first", http.StatusForbidden},
+		{"upload presenting a token nobody configured", readOnly, "PUT", key, "secret", "first", http.StatusForbidden},
+		{"upload without the token", writable, "PUT", key, "", "first", http.StatusUnauthorized},
+		{"upload with the wrong token", writable, "PUT", key, "guess", "first", http.StatusUnauthorized},
+		{"missing build", writable, "GET", key, "", "", http.StatusNotFound},
+		{"upload", writable, "PUT", key, "secret", "first", http.StatusCreated},
+		{"replacing an upload", writable, "PUT", key, "secret", "second", http.StatusConflict},
+		{"empty upload", writable, "PUT", other, "secret", "", http.StatusInternalServerError},
+		{"download", readOnly, "GET", key, "", "", http.StatusOK},
+		{"malformed key", writable, "PUT", "../state", "secret", "x", http.StatusNotFound},
+		{"other methods", writable, "DELETE", key, "secret", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		status := request(test.handler, test.method, test.key, test.token, test.body)
+		if status != test.status {
+			t.Errorf("%s: %s returned %d, expected %d", test.name, test.method, status, test.status)
+		}
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(directory, "ab", key+".tar.gz"))
+	if err != nil || string(stored) != "first" {
+		t.Errorf("the first upload was not kept: %q, %v", stored, err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What became of a file during a build
+const (
+	compiledStatus    = "compiled"
+	failedStatus      = "failed"
+	skippedStatus     = "skipped"
+	interruptedStatus = "interrupted"
+)
+
+// A StepReport records one step of compiling a file
+type StepReport struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	// Passes are the durations in seconds of each run of a step
+	// which reruns until cross-references converge
+	Passes []float64 `json:"passes,omitempty"`
+	Cached bool      `json:"cached,omitempty"`
+	Failed bool      `json:"failed,omitempty"`
+}
+
+// A FileReport records how compiling a file went
+type FileReport struct {
+	Filename    string       `json:"filename"`
+	Status      string       `json:"status"`
+	Seconds     float64      `json:"seconds"`
+	CacheHit    bool         `json:"cacheHit"`
+	Steps       []StepReport `json:"steps"`
+	Error       string       `json:"error,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// addStep records a step which started at start, along with its
+// passes if it ran until converging; a nil report records nothing
+func (report *FileReport) addStep(name string, start time.Time, passes []time.Duration, cached bool, err error) {
+	if report == nil {
+		return
+	}
+
+	step := StepReport{
+		Name:    name,
+		Seconds: time.Since(start).Seconds(),
+		Cached:  cached,
+		Failed:  err != nil,
+	}
+	for _, pass := range passes {
+		step.Passes = append(step.Passes, pass.Seconds())
+	}
+
+	report.Steps = append(report.Steps, step)
+}
+
+// finish fills in the outcome of compiling the file
+func (report *FileReport) finish(filename string, start time.Time, err error) {
+	report.Filename = filename
+	report.Seconds = time.Since(start).Seconds()
+	report.Status = compiledStatus
+
+	if err != nil {
+		report.Status = failedStatus
+		if skipped, ok := err.(*SkippedError); ok {
+			report.Status = skippedStatus
+			if skipped.Interrupted {
+				report.Status = interruptedStatus
+			}
+		}
+		report.Error = err.Error()
+	}
+
+	if compileError, ok := err.(*CompileError); ok {
+		report.Diagnostics = compileError.Diagnostics
+	}
+}
+
+// A BuildReport is what CI systems need to know about a bake
+type BuildReport struct {
+	XakeVersion string       `json:"xakeVersion"`
+	Started     time.Time    `json:"started"`
+	Seconds     float64      `json:"seconds"`
+	Compiled    int          `json:"compiled"`
+	Failed      int          `json:"failed"`
+	Skipped     int          `json:"skipped"`
+	Interrupted int          `json:"interrupted"`
+	Files       []FileReport `json:"files"`
+}
+
+// NewBuildReport summarizes the reports on each file of a build which
+// started at started, naming files relative to directory
+func NewBuildReport(directory string, version string, started time.Time, files []FileReport) BuildReport {
+	report := BuildReport{
+		XakeVersion: version,
+		Started:     started,
+		Seconds:     time.Since(started).Seconds(),
+		Files:       []FileReport{},
+	}
+
+	for _, file := range files {
+		if relative, err := filepath.Rel(directory, file.Filename); err == nil {
+			file.Filename = filepath.ToSlash(relative)
+		}
+		if file.Steps == nil {
+			file.Steps = []StepReport{}
+		}
+		if file.Diagnostics == nil {
+			file.Diagnostics = []Diagnostic{}
+		}
+
+		switch file.Status {
+		case compiledStatus:
+			report.Compiled++
+		case failedStatus:
+			report.Failed++
+		case skippedStatus:
+			report.Skipped++
+		case interruptedStatus:
+			report.Interrupted++
+		}
+
+		report.Files = append(report.Files, file)
+	}
+
+	return report
+}
+
+// WriteJsonReport saves the report as JSON
+func WriteJsonReport(filename string, report BuildReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name       string          `xml:"name,attr"`
+	Classname  string          `xml:"classname,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Failure    *junitFailure   `xml:"failure,omitempty"`
+	Skipped    *junitSkipped   `xml:"skipped,omitempty"`
+	SystemOut  string          `xml:"system-out,omitempty"`
+}
+
+// A junitProperty records the duration of a step, or of one pass of
+// it, e.g., pdflatex.pass2
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJunitReport saves the report as JUnit XML, with each file as a
+// test case, so that CI systems show which activity broke
+func WriteJunitReport(filename string, report BuildReport) error {
+	suite := junitTestSuite{
+		Name:      "xake bake",
+		Tests:     len(report.Files),
+		Failures:  report.Failed,
+		Skipped:   report.Skipped + report.Interrupted,
+		Time:      fmt.Sprintf("%.3f", report.Seconds),
+		Timestamp: report.Started.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, file := range report.Files {
+		testCase := junitTestCase{
+			Name:      file.Filename,
+			Classname: strings.Replace(filepath.ToSlash(filepath.Dir(file.Filename)), "/", ".", -1),
+			Time:      fmt.Sprintf("%.3f", file.Seconds),
+		}
+
+		var out []string
+		if file.CacheHit {
+			out = append(out, "restored from the build cache")
+		}
+		for i, step := range file.Steps {
+			// a step may run twice, e.g., pdflatex before and after sage
+			name := step.Name
+			occurrence := 1
+			for _, earlier := range file.Steps[:i] {
+				if earlier.Name == step.Name {
+					occurrence++
+				}
+			}
+			if occurrence > 1 {
+				name = fmt.Sprintf("%s.%d", step.Name, occurrence)
+			}
+
+			testCase.Properties = append(testCase.Properties, junitProperty{Name: name, Value: fmt.Sprintf("%.3f", step.Seconds)})
+			for pass, seconds := range step.Passes {
+				testCase.Properties = append(testCase.Properties, junitProperty{Name: fmt.Sprintf("%s.pass%d", name, pass+1), Value: fmt.Sprintf("%.3f", seconds)})
+			}
+
+			line := fmt.Sprintf("%s: %.3fs", step.Name, step.Seconds)
+			if len(step.Passes) > 1 {
+				var passes []string
+				for _, seconds := range step.Passes {
+					passes = append(passes, fmt.Sprintf("%.3fs", seconds))
+				}
+				line = line + fmt.Sprintf(" in %d passes (%s)", len(step.Passes), strings.Join(passes, ", "))
+			}
+			if step.Cached {
+				line = line + " (cached)"
+			}
+			if step.Failed {
+				line = line + " (failed)"
+			}
+			out = append(out, line)
+		}
+		testCase.SystemOut = strings.Join(out, "\n")
+
+		switch file.Status {
+		case failedStatus:
+			var details []string
+			for _, d := range file.Diagnostics {
+				details = append(details, d.Severity+": "+formatDiagnostic(d))
+			}
+			details = append(details, file.Error)
+			testCase.Failure = &junitFailure{Message: firstDiagnostic(file), Type: "CompileError", Text: strings.Join(details, "\n")}
+		case skippedStatus, interruptedStatus:
+			testCase.Skipped = &junitSkipped{Message: file.Error}
+		}
+
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The log format of steps whose output should be read as sage output
+const sageLogFormat = "sage"
+
+var (
+	sagetexError    = regexp.MustCompile("Error in Sage code on line ([0-9]+) of (.+?)\\.tex")
+	pythonTraceback = regexp.MustCompile("^Traceback \\(most recent call last\\):")
+	pythonException = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_.]*(Error|Exception|Interrupt|Exit)\\b")
+)
+
+// ParseSageOutput finds the errors which sage reports while running
+// the .sagetex.sage file produced for filename, together with their
+// tracebacks
+func ParseSageOutput(filename string, output []byte) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	texFile := filepath.Base(filename)
+	lineNumber := 0
+
+	matches := sagetexError.FindSubmatch(output)
+	if len(matches) > 0 {
+		lineNumber, _ = strconv.Atoi(string(matches[1]))
+		texFile = filepath.Base(string(matches[2])) + ".tex"
+	}
+
+	lines := strings.Split(string(output), "\n")
+	for i := 0; i < len(lines); i++ {
+		if !pythonTraceback.MatchString(lines[i]) {
+			continue
+		}
+
+		traceback := []string{lines[i]}
+		message := ""
+		for i+1 < len(lines) {
+			i++
+			traceback = append(traceback, lines[i])
+			if pythonException.MatchString(lines[i]) {
+				message = lines[i]
+				break
+			}
+		}
+
+		if message == "" {
+			message = "sage raised an exception"
+		}
+
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     texFile,
+			Line:     lineNumber,
+			Severity: severityError,
+			Message:  message,
+			Context:  strings.Join(traceback, "\n"),
+		})
+	}
+
+	if len(diagnostics) == 0 && len(matches) > 0 {
+		diagnostics = append(diagnostics, Diagnostic{
+			File:     texFile,
+			Line:     lineNumber,
+			Severity: severityError,
+			Message:  "Error in Sage code",
+		})
+	}
+
+	return diagnostics
+}
+
+func hasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == severityError {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSageOutput(t *testing.T) {
+	traceback := "Traceback (most recent call last):\n  File \"activity.sagetex.sage\", line 20, in <module>\n    x = Integer(1)/0\nZeroDivisionError: rational division by zero"
+
+	tests := []struct {
+		name        string
+		output      string
+		diagnostics []Diagnostic
+	}{
+		{
+			name:   "sagetex error with traceback",
+			output: "Processing Sage code for activity.sagetex.sage...\n" + traceback + "\nError in Sage code on line 14 of activity.tex! Traceback follows.\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Line: 14, Severity: severityError, Message: "ZeroDivisionError: rational division by zero", Context: traceback},
+			},
+		},
+		{
+			name:   "sagetex error in a subdirectory",
+			output: "Error in Sage code on line 3 of chapter/intro.tex! Traceback follows.\n",
+			diagnostics: []Diagnostic{
+				{File: "intro.tex", Line: 3, Severity: severityError, Message: "Error in Sage code"},
+			},
+		},
+		{
+			name:   "traceback without a sagetex error",
+			output: traceback + "\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Severity: severityError, Message: "ZeroDivisionError: rational division by zero", Context: traceback},
+			},
+		},
+		{
+			name:   "two tracebacks",
+			output: "Traceback (most recent call last):\nNameError: name 'y' is not defined\nTraceback (most recent call last):\nKeyboardInterrupt\n",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Severity: severityError, Message: "NameError: name 'y' is not defined", Context: "Traceback (most recent call last):\nNameError: name 'y' is not defined"},
+				{File: "activity.tex", Severity: severityError, Message: "KeyboardInterrupt", Context: "Traceback (most recent call last):\nKeyboardInterrupt"},
+			},
+		},
+		{
+			name:   "truncated traceback",
+			output: "Traceback (most recent call last):\n  File \"x.py\", line 1",
+			diagnostics: []Diagnostic{
+				{File: "activity.tex", Severity: severityError, Message: "sage raised an exception", Context: "Traceback (most recent call last):\n  File \"x.py\", line 1"},
+			},
+		},
+		{
+			name:        "successful run",
+			output:      "Processing Sage code for activity.sagetex.sage...\nSage processing complete. Run LaTeX on activity.tex again.\n",
+			diagnostics: nil,
+		},
+	}
+
+	for _, test := range tests {
+		diagnostics := ParseSageOutput("/tmp/scratch/activity.tex", []byte(test.output))
+		if !reflect.DeepEqual(diagnostics, test.diagnostics) {
+			t.Errorf("%s: ParseSageOutput found\n%#v\nexpected\n%#v", test.name, diagnostics, test.diagnostics)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Files produced by a backend which are copied back into the
+// repository, unless the backend declares its own outputs
+var defaultOutputs = []string{
+	"$JOBNAME.html",
+	"*.svg",
+	"*.png",
+	"*.jpg",
+	"*.jpeg",
+	"*.gif",
+}
+
+// A scratchDirectory mirrors just the inputs needed to compile one
+// file, so that simultaneous compilations cannot trample one
+// another's .aux, .idv or .lg files and the working tree is not
+// littered with intermediate files.
+type scratchDirectory struct {
+	// root is the temporary directory standing in for the repository
+	root string
+
+	// repository and filename are absolute paths in the real repository
+	repository string
+	filename   string
+
+	// filename is found at this path in the scratch directory
+	scratchFilename string
+
+	// mirrored holds the (repository-relative) paths of the inputs
+	mirrored map[string]bool
+
+	// figures holds the hashes of the externalized TikZ figures which
+	// were copied in, keyed by their paths in the scratch directory
+	figures map[string]string
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// htlatex numbers the pictures it makes, e.g., job0x.png
+var htlatexPicturePattern = regexp.MustCompile("^[0-9]+x\\.")
+
+// isNamedForJob reports whether name was named after jobname, as in
+// job.html, job-figure1.svg or job0x.png, rather than merely starting
+// with it, as jobs.tex does
+func isNamedForJob(name string, jobname string) bool {
+	if !strings.HasPrefix(name, jobname) {
+		return false
+	}
+
+	rest := name[len(jobname):]
+	return strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, "-") || htlatexPicturePattern.MatchString(rest)
+}
+
+var generatedExtensions = []string{".html", ".svg", ".png", ".jpg", ".jpeg", ".gif"}
+
+// looksGenerated guesses whether name was produced by compiling one
+// of the .tex files in the same directory, since htlatex and
+// tikzexport name their images after the job, e.g., job0x.png or
+// job-figure1.svg.  Images which are really included are found by
+// IncludedImages anyway.
+func looksGenerated(name string, jobnames []string) bool {
+	if !stringInSlice(strings.ToLower(filepath.Ext(name)), generatedExtensions) {
+		return false
+	}
+
+	for _, jobname := range jobnames {
+		if isNamedForJob(name, jobname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// figureCacheExtensions are the files TikZ externalization keeps for
+// each figure: the .md5 of the code which drew it, its depth, and the
+// pictures themselves
+var figureCacheExtensions = "md5|dpth|pdf|svg|png"
+
+// figureCachePattern matches the externalized figures of jobname,
+// e.g., job-figure1.md5 or job-figure1.svg
+func figureCachePattern(jobname string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(jobname) + "-figure[0-9]+\\.(" + figureCacheExtensions + ")$")
+}
+
+// compilationInputs lists the files which filename might read: the
+// ordinary files sitting next to it or next to anything it inputs,
+// and everything it depends on.
+func compilationInputs(filename string) []string {
+	var inputs []string
+	seen := make(map[string]bool)
+	visited := make(map[string]bool)
+	visitedDirectories := make(map[string]bool)
+
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			inputs = append(inputs, path)
+		}
+	}
+
+	queue := []string{filename}
+	for len(queue) > 0 {
+		texFilename := queue[0]
+		queue = queue[1:]
+
+		if visited[texFilename] {
+			continue
+		}
+		visited[texFilename] = true
+		add(texFilename)
+
+		directory := filepath.Dir(texFilename)
+		if !visitedDirectories[directory] {
+			visitedDirectories[directory] = true
+
+			siblings, err := ioutil.ReadDir(directory)
+			if err == nil {
+				var jobnames []string
+				for _, sibling := range siblings {
+					if filepath.Ext(sibling.Name()) == ".tex" {
+						jobnames = append(jobnames, strings.TrimSuffix(sibling.Name(), ".tex"))
+					}
+				}
+
+				for _, sibling := range siblings {
+					if sibling.Mode().IsRegular() && !isDeletable(sibling.Name()) && !looksGenerated(sibling.Name(), jobnames) {
+						add(filepath.Join(directory, sibling.Name()))
+					}
+				}
+			}
+		}
+
+		dependencies, err := FileDependencies(texFilename)
+		if err == nil {
+			for _, dependency := range dependencies {
+				if isTextualDependency(dependency) {
+					queue = append(queue, dependency.Filename)
+				} else {
+					add(dependency.Filename)
+				}
+			}
+		}
+	}
+
+	return inputs
+}
+
+// newScratchDirectory creates a temporary directory laid out like the
+// repository, containing copies of the inputs of filename
+func newScratchDirectory(repository string, filename string) (*scratchDirectory, error) {
+	repository, err := filepath.Abs(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err = filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	relativeFilename, err := filepath.Rel(repository, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := ioutil.TempDir("", "xake-")
+	if err != nil {
+		return nil, err
+	}
+
+	scratch := &scratchDirectory{
+		root:            root,
+		repository:      repository,
+		filename:        filename,
+		scratchFilename: filepath.Join(root, relativeFilename),
+		mirrored:        make(map[string]bool),
+		figures:         make(map[string]string),
+	}
+
+	for _, input := range compilationInputs(filename) {
+		err := scratch.mirror(input)
+		if err != nil {
+			scratch.remove()
+			return nil, err
+		}
+	}
+
+	err = scratch.copyFiguresIn()
+	if err != nil {
+		scratch.remove()
+		return nil, err
+	}
+
+	return scratch, nil
+}
+
+// copyFiguresIn copies the TikZ figures which an earlier compilation
+// externalized into the scratch directory, so that TikZ does not
+// redraw those whose code has not changed.
+func (scratch *scratchDirectory) copyFiguresIn() error {
+	directory := filepath.Dir(scratch.filename)
+	pattern := figureCachePattern(strings.TrimSuffix(filepath.Base(scratch.filename), filepath.Ext(scratch.filename)))
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !pattern.MatchString(file.Name()) {
+			continue
+		}
+
+		destination := filepath.Join(filepath.Dir(scratch.scratchFilename), file.Name())
+		if relative, err := filepath.Rel(scratch.root, destination); err == nil && scratch.mirrored[relative] {
+			continue
+		}
+
+		err = copyFile(filepath.Join(directory, file.Name()), destination)
+		if err != nil {
+			return err
+		}
+
+		hash, err := hashFile(destination)
+		if err != nil {
+			return err
+		}
+		scratch.figures[destination] = hash
+	}
+
+	return nil
+}
+
+// copyFiguresOut copies the TikZ figures which were drawn or redrawn
+// back into the repository, for the next compilation to reuse
+func (scratch *scratchDirectory) copyFiguresOut() error {
+	outputDirectory := filepath.Dir(scratch.scratchFilename)
+	pattern := figureCachePattern(strings.TrimSuffix(filepath.Base(scratch.scratchFilename), filepath.Ext(scratch.scratchFilename)))
+
+	files, err := ioutil.ReadDir(outputDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !pattern.MatchString(file.Name()) {
+			continue
+		}
+
+		path := filepath.Join(outputDirectory, file.Name())
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if previous, ok := scratch.figures[path]; ok && previous == hash {
+			continue
+		}
+
+		log.Debug("Copying the figure " + file.Name() + " into the repository")
+		err = copyFile(path, filepath.Join(filepath.Dir(scratch.filename), file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mirror places a copy of path at the same relative location in the
+// scratch directory.  It is a copy rather than a link, so that a tool
+// which opens an input for writing (sagetex, make4ht, or \openout on
+// an existing file) cannot write through into the repository.
+func (scratch *scratchDirectory) mirror(path string) error {
+	relative, err := filepath.Rel(scratch.repository, path)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(relative, "..") {
+		log.Debug("Not mirroring " + path + " since it lies outside of " + scratch.repository)
+		return nil
+	}
+
+	if scratch.mirrored[relative] {
+		return nil
+	}
+
+	destination := filepath.Join(scratch.root, relative)
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(path, destination)
+	if err != nil {
+		return err
+	}
+
+	scratch.mirrored[relative] = true
+	return nil
+}
+
+// copyOutputs copies the newly created files matching patterns from
+// the scratch directory back into the repository, and returns their
+// paths in the repository
+func (scratch *scratchDirectory) copyOutputs(patterns []string) ([]string, error) {
+	var outputs []string
+	copied := make(map[string]bool)
+
+	outputDirectory := filepath.Dir(scratch.scratchFilename)
+
+	for _, pattern := range patterns {
+		pattern = expandStepString(pattern, scratch.scratchFilename)
+
+		matches, err := filepath.Glob(filepath.Join(outputDirectory, pattern))
+		if err != nil {
+			return outputs, err
+		}
+
+		for _, match := range matches {
+			relative, err := filepath.Rel(scratch.root, match)
+			if err != nil {
+				return outputs, err
+			}
+
+			if scratch.mirrored[relative] || copied[relative] {
+				continue
+			}
+			copied[relative] = true
+
+			info, err := os.Lstat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			destination := filepath.Join(scratch.repository, relative)
+			log.Debug("Copying " + relative + " into the repository")
+			err = copyFile(match, destination)
+			if err != nil {
+				return outputs, err
+			}
+
+			outputs = append(outputs, destination)
+		}
+	}
+
+	return outputs, nil
+}
+
+func (scratch *scratchDirectory) remove() {
+	os.RemoveAll(scratch.root)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLooksGenerated(t *testing.T) {
+	jobnames := []string{"intro", "graph"}
+
+	tests := []struct {
+		name      string
+		generated bool
+	}{
+		{"intro.html", true},
+		{"intro0x.png", true},
+		{"intro12x.png", true},
+		{"intro-figure1.svg", true},
+		{"graph.svg", true},
+		{"introduction.png", false},
+		{"intro2.png", false},
+		{"introduction.tex", false},
+		{"intro.tex", false},
+		{"other.png", false},
+	}
+
+	for _, test := range tests {
+		generated := looksGenerated(test.name, jobnames)
+		if generated != test.generated {
+			t.Errorf("looksGenerated(%q) = %v, expected %v", test.name, generated, test.generated)
+		}
+	}
+}
+
+func TestScratchDirectoryCopiesInputs(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{
+		"macros.tex":                 "\\newcommand{\\x}{x}\n",
+		"chapter/intro.tex":          "\\input{../macros}\n\\includegraphics{introduction}\n",
+		"chapter/introduction.png":   "picture",
+		"chapter/intro.sagetex.sage": "old",
+	})
+
+	scratch, err := newScratchDirectory(directory, filepath.Join(directory, "chapter", "intro.tex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scratch.remove()
+
+	for _, name := range []string{"macros.tex", "chapter/introduction.png", "chapter/intro.sagetex.sage"} {
+		path := filepath.Join(scratch.root, filepath.FromSlash(name))
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("%s was not mirrored: %s", name, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("%s was mirrored as %s rather than copied", name, info.Mode())
+		}
+	}
+
+	// a step writing to one of its inputs leaves the repository alone
+	err = ioutil.WriteFile(filepath.Join(scratch.root, "chapter", "intro.sagetex.sage"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(filepath.Join(directory, "chapter", "intro.sagetex.sage"))
+	if string(contents) != "old" {
+		t.Errorf("writing in the scratch directory changed the repository")
+	}
+}
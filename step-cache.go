@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// cacheDirectory is where xake keeps results between runs, following
+// the XDG convention of ~/.cache/xake
+func cacheDirectory() (string, error) {
+	if runtime.GOOS == "windows" {
+		if local := os.Getenv("LocalAppData"); local != "" {
+			return filepath.Join(local, "xake"), nil
+		}
+	}
+
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		return filepath.Join(xdg, "xake"), nil
+	}
+
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", fmt.Errorf("Could not find a home directory for the cache")
+	}
+
+	return filepath.Join(home, ".cache", "xake"), nil
+}
+
+// copyTree copies a file, or a directory and everything inside it
+func copyTree(source string, destination string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return copyFile(source, destination)
+	}
+
+	err = os.MkdirAll(destination, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	children, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		err = copyTree(filepath.Join(source, child.Name()), filepath.Join(destination, child.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stepCacheKey combines the hash of the step's CacheKey file with the
+// command line, so that changing either one misses the cache
+func stepCacheKey(step BuildStep, filename string) (string, error) {
+	keyFilename := filepath.Join(filepath.Dir(filename), expandStepString(step.CacheKey, filename))
+
+	hash, err := HashObject(keyFilename)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\000%s\000%s", hash, step.Command, strings.Join(step.Arguments, "\000"))
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func stepCachePath(step BuildStep, key string) (string, error) {
+	directory, err := cacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, "steps", step.Name, key), nil
+}
+
+// restoreStepOutputs copies previously saved results next to
+// filename, and reports whether there were any to copy
+func restoreStepOutputs(step BuildStep, key string, filename string) bool {
+	cached, err := stepCachePath(step, key)
+	if err != nil || !exists(cached) {
+		return false
+	}
+
+	for _, output := range step.CacheOutputs {
+		name := expandStepString(output, filename)
+		source := filepath.Join(cached, name)
+
+		if exists(source) {
+			err := copyTree(source, filepath.Join(filepath.Dir(filename), name))
+			if err != nil {
+				log.Debug(err)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// saveStepOutputs stores the results of a step; the results are
+// assembled elsewhere and renamed into place, so a simultaneous
+// compilation never sees a half-written entry.
+func saveStepOutputs(step BuildStep, key string, filename string) error {
+	cached, err := stepCachePath(step, key)
+	if err != nil {
+		return err
+	}
+
+	if exists(cached) {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(cached), 0755)
+	if err != nil {
+		return err
+	}
+
+	temporary, err := ioutil.TempDir(filepath.Dir(cached), "incoming-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temporary)
+
+	for _, output := range step.CacheOutputs {
+		name := expandStepString(output, filename)
+		source := filepath.Join(filepath.Dir(filename), name)
+
+		if exists(source) {
+			err := copyTree(source, filepath.Join(temporary, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = os.Rename(temporary, cached)
+	if err != nil && exists(cached) {
+		// someone else saved the same results first
+		return nil
+	}
+	return err
+}
+
+// runCachedStep reuses the saved results of the step when its
+// CacheKey file is unchanged, and otherwise runs it and saves the
+// results.  It reports whether the cache was used.
+func runCachedStep(ctx context.Context, step BuildStep, filename string) ([]byte, bool, error) {
+	key, err := stepCacheKey(step, filename)
+	if err != nil {
+		log.Debug(err)
+		output, err := runBuildStep(ctx, step, filename)
+		return output, false, err
+	}
+
+	if restoreStepOutputs(step, key, filename) {
+		log.Debug("Using cached results of " + step.Name + " for " + filepath.Base(filename))
+		return []byte{}, true, nil
+	}
+
+	output, err := runBuildStep(ctx, step, filename)
+	if err != nil {
+		return output, false, err
+	}
+
+	err = saveStepOutputs(step, key, filename)
+	if err != nil {
+		log.Warn("Could not save the results of " + step.Name + ": " + err.Error())
+	}
+
+	return output, false, nil
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Environments whose contents TeX does not interpret as commands
+var verbatimEnvironments = []string{
+	"verbatim",
+	"verbatim*",
+	"Verbatim",
+	"Verbatim*",
+	"comment",
+	"lstlisting",
+	"minted",
+	"filecontents",
+	"filecontents*",
+}
+
+// Commands which take their argument verbatim, between two copies of
+// a delimiter, e.g., \verb|\input{x}|
+var verbatimCommands = []string{"verb", "verb*", "lstinline", "mintinline"}
+
+// A texCommand is a control word found by scanTex, along with the
+// optional and mandatory arguments which immediately follow it
+type texCommand struct {
+	name      string
+	line      int
+	optional  []string
+	arguments []string
+}
+
+// A TexDependency is a file needed by a .tex file, along with the
+// command and line which mention it
+type TexDependency struct {
+	Filename string
+	Command  string
+	Kind     string
+	Line     int
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// blankVerbatim replaces code[start:end] with spaces, keeping
+// newlines so that line numbers are unchanged
+func blankVerbatim(code []byte, start int, end int) {
+	if end > len(code) {
+		end = len(code)
+	}
+
+	for i := start; i < end; i++ {
+		if code[i] != '\n' {
+			code[i] = ' '
+		}
+	}
+}
+
+// controlWord reads the name of the control sequence beginning with
+// the backslash at code[i], and returns it with the index just past it
+func controlWord(code []byte, i int) (string, int) {
+	j := i + 1
+	for j < len(code) && isLetter(code[j]) {
+		j++
+	}
+
+	if j == i+1 && j < len(code) {
+		// a control symbol like \% or \\
+		j++
+	}
+
+	return string(code[i+1 : j]), j
+}
+
+// stripTex blanks out comments and anything verbatim, so that what
+// remains can be scanned for commands
+func stripTex(data []byte) []byte {
+	code := append([]byte{}, data...)
+
+	for i := 0; i < len(code); {
+		switch code[i] {
+		case '%':
+			end := i
+			for end < len(code) && code[end] != '\n' {
+				end++
+			}
+			blankVerbatim(code, i, end)
+			i = end
+
+		case '\\':
+			name, j := controlWord(code, i)
+			if j < len(code) && code[j] == '*' && name == "verb" {
+				j++
+				name = name + "*"
+			}
+
+			if stringInSlice(name, verbatimCommands) && j < len(code) {
+				// \lstinline and \mintinline may have options first
+				_, j = readGroup(code, j, '[')
+				if name == "mintinline" {
+					_, j = readGroup(code, j, '{')
+				}
+				if j >= len(code) {
+					i = j
+					continue
+				}
+
+				delimiter := code[j]
+				if delimiter == '{' {
+					delimiter = '}'
+				}
+
+				end := j + 1
+				for end < len(code) && code[end] != delimiter && code[end] != '\n' {
+					end++
+				}
+				blankVerbatim(code, i, end+1)
+				i = end + 1
+				continue
+			}
+
+			if name == "begin" {
+				environment, _ := readGroup(code, skipSpaces(code, j), '{')
+				if stringInSlice(environment, verbatimEnvironments) {
+					finish := []byte("\\end{" + environment + "}")
+					end := strings.Index(string(code[j:]), string(finish))
+					if end < 0 {
+						end = len(code)
+					} else {
+						end = j + end + len(finish)
+					}
+					blankVerbatim(code, i, end)
+					i = end
+					continue
+				}
+			}
+
+			i = j
+
+		default:
+			i++
+		}
+	}
+
+	return code
+}
+
+func skipSpaces(code []byte, i int) int {
+	for i < len(code) && (code[i] == ' ' || code[i] == '\t' || code[i] == '\n' || code[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// readGroup reads the balanced group which starts with open (either
+// '{' or '[') at code[i], returning its contents and the index just
+// past the group; when there is no such group, the index is i
+func readGroup(code []byte, i int, open byte) (string, int) {
+	if i >= len(code) || code[i] != open {
+		return "", i
+	}
+
+	depth := 0
+	for j := i; j < len(code); j++ {
+		switch code[j] {
+		case '\\':
+			// skip the escaped character, as in \} or \]
+			j++
+			continue
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+
+		if open == '[' && code[j] == ']' && depth == 0 {
+			return string(code[i+1 : j]), j + 1
+		}
+
+		if open == '{' && depth == 0 {
+			return string(code[i+1 : j]), j + 1
+		}
+	}
+
+	return "", i
+}
+
+// scanTex finds each command in the given TeX code, along with its
+// arguments; commands inside of arguments are found as well
+func scanTex(data []byte) []texCommand {
+	var commands []texCommand
+
+	code := stripTex(data)
+	line := 1
+	for i := 0; i < len(code); {
+		if code[i] == '\n' {
+			line++
+			i++
+			continue
+		}
+
+		if code[i] != '\\' {
+			i++
+			continue
+		}
+
+		name, j := controlWord(code, i)
+		i = j
+
+		if name == "" || !isLetter(name[0]) {
+			continue
+		}
+
+		command := texCommand{name: name, line: line}
+
+		j = skipSpaces(code, j)
+		if j < len(code) && code[j] == '*' {
+			j++
+		}
+
+		for {
+			k := skipSpaces(code, j)
+			if k >= len(code) {
+				break
+			}
+
+			if code[k] == '[' {
+				argument, end := readGroup(code, k, '[')
+				if end == k {
+					break
+				}
+				command.optional = append(command.optional, argument)
+				j = end
+			} else if code[k] == '{' {
+				argument, end := readGroup(code, k, '{')
+				if end == k {
+					break
+				}
+				command.arguments = append(command.arguments, argument)
+				j = end
+			} else {
+				break
+			}
+		}
+
+		// \addplot table [options] {data.csv} names its file after a keyword
+		if (name == "addplot" || name == "addplot3") && len(command.arguments) == 0 {
+			k := skipSpaces(code, j)
+			if k < len(code) && code[k] == '+' {
+				k++
+			}
+			for {
+				_, end := readGroup(code, skipSpaces(code, k), '[')
+				if end == skipSpaces(code, k) {
+					break
+				}
+				k = end
+			}
+
+			k = skipSpaces(code, k)
+			end := k
+			for end < len(code) && isLetter(code[end]) {
+				end++
+			}
+
+			keyword := string(code[k:end])
+			if keyword == "table" || keyword == "file" {
+				k = skipSpaces(code, end)
+				_, k = readGroup(code, k, '[')
+				argument, end := readGroup(code, skipSpaces(code, k), '{')
+				if end > k {
+					command.arguments = append(command.arguments, argument)
+				}
+			}
+		}
+
+		// \input accepts a bare filename, too
+		if name == "input" && len(command.arguments) == 0 {
+			k := skipSpaces(code, j)
+			end := k
+			for end < len(code) && !strings.ContainsRune(" \t\r\n\\{}%", rune(code[end])) {
+				end++
+			}
+			if end > k {
+				command.arguments = append(command.arguments, string(code[k:end]))
+			}
+		}
+
+		commands = append(commands, command)
+	}
+
+	return commands
+}
+
+// scanTexFile scans the TeX code in filename
+func scanTexFile(filename string) ([]texCommand, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []texCommand{}, err
+	}
+
+	return scanTex(data), nil
+}
+
+// resolveTexFilename finds name (relative to directory) as written,
+// or with any of the given extensions
+func resolveTexFilename(directory string, name string, extensions []string) []string {
+	var results []string
+
+	resolved, err := filepath.Abs(filepath.Join(directory, strings.TrimSpace(name)))
+	if err != nil {
+		return results
+	}
+
+	if info, err := os.Stat(resolved); err == nil && !info.IsDir() {
+		return append(results, resolved)
+	}
+
+	for _, extension := range extensions {
+		if exists(resolved + extension) {
+			results = append(results, resolved+extension)
+		}
+	}
+
+	return results
+}
+
+// A dependencyCommand describes how a command names the files it reads
+type dependencyCommand struct {
+	kind string
+
+	// extensions are tried when the file is named without one
+	extensions []string
+
+	// argument is the index of the mandatory argument naming the file
+	argument int
+
+	// directory, unless it is negative, is the index of the argument
+	// naming the directory which holds the file, as for \import
+	directory int
+
+	// list is true when the argument may name several files,
+	// separated by commas
+	list bool
+}
+
+// The kinds of dependencies; the contents of "input", "package" and
+// "class" dependencies are TeX, and are scanned in turn
+const (
+	inputDependency        = "input"
+	packageDependency      = "package"
+	classDependency        = "class"
+	listingDependency      = "listing"
+	bibliographyDependency = "bibliography"
+	dataDependency         = "data"
+	imageDependency        = "image"
+)
+
+var texExtensions = []string{".tex"}
+
+var dependencyCommands = map[string]dependencyCommand{
+	"input":             {kind: inputDependency, extensions: texExtensions, directory: -1},
+	"activity":          {kind: inputDependency, extensions: texExtensions, directory: -1},
+	"include":           {kind: inputDependency, extensions: texExtensions, directory: -1},
+	"includeonly":       {kind: inputDependency, extensions: texExtensions, directory: -1, list: true},
+	"subfile":           {kind: inputDependency, extensions: texExtensions, directory: -1},
+	"import":            {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"subimport":         {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"inputfrom":         {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"subinputfrom":      {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"includefrom":       {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"subincludefrom":    {kind: inputDependency, extensions: texExtensions, argument: 1, directory: 0},
+	"usepackage":        {kind: packageDependency, extensions: []string{".sty"}, directory: -1, list: true},
+	"RequirePackage":    {kind: packageDependency, extensions: []string{".sty"}, directory: -1, list: true},
+	"documentclass":     {kind: classDependency, extensions: []string{".cls"}, directory: -1},
+	"LoadClass":         {kind: classDependency, extensions: []string{".cls"}, directory: -1},
+	"lstinputlisting":   {kind: listingDependency, directory: -1},
+	"verbatiminput":     {kind: listingDependency, directory: -1},
+	"inputminted":       {kind: listingDependency, argument: 1, directory: -1},
+	"bibliography":      {kind: bibliographyDependency, extensions: []string{".bib"}, directory: -1, list: true},
+	"addbibresource":    {kind: bibliographyDependency, directory: -1},
+	"addplot":           {kind: dataDependency, directory: -1},
+	"addplot3":          {kind: dataDependency, directory: -1},
+	"pgfplotstableread": {kind: dataDependency, directory: -1},
+}
+
+// isTextualDependency reports whether a dependency contains TeX code
+// which may mention further dependencies
+func isTextualDependency(dependency TexDependency) bool {
+	return dependency.Kind == inputDependency || dependency.Kind == packageDependency || dependency.Kind == classDependency
+}
+
+// commandDependencies lists the files named by the commands in
+// filename, other than images
+func commandDependencies(filename string) ([]TexDependency, error) {
+	var dependencies []TexDependency
+
+	commands, err := scanTexFile(filename)
+	if err != nil {
+		return dependencies, err
+	}
+
+	for _, command := range commands {
+		description, ok := dependencyCommands[command.name]
+		if !ok || len(command.arguments) <= description.argument || len(command.arguments) <= description.directory {
+			continue
+		}
+
+		directory := filepath.Dir(filename)
+		if description.directory >= 0 {
+			directory = filepath.Join(directory, strings.TrimSpace(command.arguments[description.directory]))
+		}
+
+		names := []string{command.arguments[description.argument]}
+		if description.list {
+			names = strings.Split(names[0], ",")
+		}
+
+		for _, name := range names {
+			for _, resolved := range resolveTexFilename(directory, name, description.extensions) {
+				dependencies = append(dependencies, TexDependency{Filename: resolved, Command: command.name, Kind: description.kind, Line: command.line})
+			}
+		}
+	}
+
+	return dependencies, nil
+}
+
+// TexDependencies lists the .tex files which filename inputs
+func TexDependencies(filename string) ([]TexDependency, error) {
+	var inputs []TexDependency
+
+	dependencies, err := commandDependencies(filename)
+	if err != nil {
+		return inputs, err
+	}
+
+	for _, dependency := range dependencies {
+		if dependency.Kind == inputDependency {
+			inputs = append(inputs, dependency)
+		}
+	}
+
+	return inputs, nil
+}
+
+// FileDependencies lists every file in the repository which filename
+// reads directly: inputs, local packages and classes, listings,
+// bibliographies, data for plots, and images
+func FileDependencies(filename string) ([]TexDependency, error) {
+	dependencies, err := commandDependencies(filename)
+	if err != nil {
+		return dependencies, err
+	}
+
+	images, err := ImageDependencies(filename)
+	if err != nil {
+		return dependencies, err
+	}
+
+	return append(dependencies, images...), nil
+}
+
+// AllDependencies lists the files which filename reads, directly or
+// through the files it inputs
+func AllDependencies(filename string) ([]string, error) {
+	var result []string
+
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return result, err
+	}
+
+	seen := map[string]bool{filename: true}
+	queue := []string{filename}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		dependencies, err := FileDependencies(current)
+		if err != nil {
+			if current == filename {
+				return result, err
+			}
+			continue
+		}
+
+		for _, dependency := range dependencies {
+			if seen[dependency.Filename] {
+				continue
+			}
+			seen[dependency.Filename] = true
+			result = append(result, dependency.Filename)
+
+			if isTextualDependency(dependency) {
+				queue = append(queue, dependency.Filename)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// Extensions tried by pdflatex and htlatex for an image named without one
+var imageExtensions = []string{".pdf", ".png", ".jpg", ".jpeg", ".svg", ".eps", ".gif"}
+
+// graphicsPaths lists the directories named by \graphicspath in
+// filename, or in the files it inputs, since a shared preamble is the
+// usual place for it
+func graphicsPaths(filename string, visited map[string]bool) []string {
+	var paths []string
+
+	if visited[filename] {
+		return paths
+	}
+	visited[filename] = true
+
+	commands, err := scanTexFile(filename)
+	if err != nil {
+		return paths
+	}
+
+	for _, command := range commands {
+		if command.name == "graphicspath" && len(command.arguments) > 0 {
+			code := []byte(command.arguments[0])
+			for i := skipSpaces(code, 0); i < len(code); i = skipSpaces(code, i) {
+				path, end := readGroup(code, i, '{')
+				if end == i {
+					break
+				}
+				paths = append(paths, path)
+				i = end
+			}
+		}
+	}
+
+	dependencies, err := TexDependencies(filename)
+	if err == nil {
+		for _, dependency := range dependencies {
+			paths = append(paths, graphicsPaths(dependency.Filename, visited)...)
+		}
+	}
+
+	return paths
+}
+
+// ImageDependencies lists the images which filename includes, looking
+// in the directories named by \graphicspath as TeX would
+func ImageDependencies(filename string) ([]TexDependency, error) {
+	var images []TexDependency
+
+	commands, err := scanTexFile(filename)
+	if err != nil {
+		return images, err
+	}
+
+	directory := filepath.Dir(filename)
+	directories := []string{directory}
+	for _, path := range graphicsPaths(filename, make(map[string]bool)) {
+		directories = append(directories, filepath.Join(directory, path))
+	}
+
+	for _, command := range commands {
+		if command.name != "includegraphics" || len(command.arguments) == 0 {
+			continue
+		}
+
+		for _, directory := range directories {
+			resolved := resolveTexFilename(directory, command.arguments[0], imageExtensions)
+			for _, image := range resolved {
+				images = append(images, TexDependency{Filename: image, Command: command.name, Kind: imageDependency, Line: command.line})
+			}
+			if len(resolved) > 0 {
+				break
+			}
+		}
+	}
+
+	return images, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// describeCommands writes commands as name@line[optional]{argument},
+// which is easier to compare than the structs themselves
+func describeCommands(commands []texCommand) []string {
+	var descriptions []string
+	for _, command := range commands {
+		description := fmt.Sprintf("%s@%d", command.name, command.line)
+		for _, optional := range command.optional {
+			description += "[" + optional + "]"
+		}
+		for _, argument := range command.arguments {
+			description += "{" + argument + "}"
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
+
+func TestScanTex(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		commands []string
+	}{
+		{"input", "\\input{a}", []string{"input@1{a}"}},
+		{"bare input", "\\input a.tex\n\\input{b}", []string{"input@1{a.tex}", "input@2{b}"}},
+		{"line numbers", "\n\n\\usepackage{a,b}", []string{"usepackage@3{a,b}"}},
+		{"optional arguments", "\\includegraphics[width=2in]{pic}", []string{"includegraphics@1[width=2in]{pic}"}},
+		{"spaces between arguments", "\\usepackage [utf8] {inputenc}", []string{"usepackage@1[utf8]{inputenc}"}},
+		{"two arguments", "\\import{dir/}{file}", []string{"import@1{dir/}{file}"}},
+		{"starred command", "\\section*{Title}", []string{"section@1{Title}"}},
+		{"nested braces", "\\title{A {B} C}", []string{"title@1{A {B} C}"}},
+		{"command inside an argument", "\\textbf{\\input{x}}", []string{"textbf@1{\\input{x}}", "input@1{x}"}},
+		{"control symbols", "\\\\ \\{ \\input{y}", []string{"input@1{y}"}},
+
+		{"comment", "% \\input{hidden}\n\\input{shown}", []string{"input@2{shown}"}},
+		{"comment after code", "\\input{x} % \\input{y}", []string{"input@1{x}"}},
+		{"escaped percent", "50\\% of \\input{x}", []string{"input@1{x}"}},
+
+		{"verbatim", "\\begin{verbatim}\n\\input{no}\n\\end{verbatim}\n\\input{yes}", []string{"input@4{yes}"}},
+		{"lstlisting with options", "\\begin{lstlisting}[language=TeX]\n\\input{no}\n\\end{lstlisting}\\input{yes}", []string{"input@3{yes}"}},
+		{"unterminated comment environment", "\\begin{comment}\\input{no}", nil},
+		{"verb", "\\verb|\\input{no}| \\verb*+\\input{no}+ \\input{yes}", []string{"input@1{yes}"}},
+		{"lstinline and mintinline", "\\lstinline[language=TeX]{\\input{no}} \\mintinline{tex}|\\input{no}| \\input{yes}", []string{"input@1{yes}"}},
+
+		{"graphicspath", "\\graphicspath{{images/}{figs/}}", []string{"graphicspath@1{{images/}{figs/}}"}},
+		{"addplot table", "\\addplot table [x=a, y=b] {data.csv};", []string{"addplot@1{data.csv}"}},
+		{"addplot file", "\\addplot+[red] file {more.dat};", []string{"addplot@1{more.dat}"}},
+	}
+
+	for _, test := range tests {
+		commands := describeCommands(scanTex([]byte(test.code)))
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s: scanTex(%q) found %q, expected %q", test.name, test.code, commands, test.commands)
+		}
+	}
+}
+
+func TestReadGroup(t *testing.T) {
+	tests := []struct {
+		code     string
+		open     byte
+		contents string
+		end      int
+	}{
+		{"{abc}def", '{', "abc", 5},
+		{"{a{b}c}", '{', "a{b}c", 7},
+		{"{a\\}b}", '{', "a\\}b", 6},
+		{"[x={1]}]", '[', "x={1]}", 8},
+		{"abc", '{', "", 0},
+		{"{unbalanced", '{', "", 0},
+	}
+
+	for _, test := range tests {
+		contents, end := readGroup([]byte(test.code), 0, test.open)
+		if contents != test.contents || end != test.end {
+			t.Errorf("readGroup(%q, %q) = %q, %d; expected %q, %d", test.code, test.open, contents, end, test.contents, test.end)
+		}
+	}
+}
+
+// writeFiles creates the given files, with their contents, beneath
+// directory
+func writeFiles(t *testing.T, directory string, files map[string]string) {
+	for name, contents := range files {
+		filename := filepath.Join(directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTexAndImageDependencies(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{
+		"main.tex": strings.Join([]string{
+			"\\documentclass{ximera}",
+			"\\input{preamble}",
+			"\\begin{document}",
+			"\\includegraphics{cat}",
+			"\\includegraphics[width=1in]{dog.png}",
+			"% \\includegraphics{hidden}",
+			"\\input{missing}",
+			"\\end{document}",
+		}, "\n"),
+		"preamble.tex":     "\\graphicspath{{images/}{figures/}}\n",
+		"figures/cat.png":  "",
+		"images/dog.png":   "",
+		"figures/dog.png":  "",
+		"hidden.png":       "",
+		"images/other.png": "",
+	})
+
+	var found []string
+	describe := func(dependencies []TexDependency, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dependency := range dependencies {
+			relative, _ := filepath.Rel(directory, dependency.Filename)
+			found = append(found, fmt.Sprintf("%s %s@%d", filepath.ToSlash(relative), dependency.Command, dependency.Line))
+		}
+	}
+	describe(TexDependencies(filepath.Join(directory, "main.tex")))
+	describe(ImageDependencies(filepath.Join(directory, "main.tex")))
+
+	// the first directory in \graphicspath holding an image wins
+	expected := []string{
+		"preamble.tex input@2",
+		"figures/cat.png includegraphics@4",
+		"images/dog.png includegraphics@5",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("found %q, expected %q", found, expected)
+	}
+}
+
+func TestFileDependencies(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{
+		"main.tex": strings.Join([]string{
+			"\\documentclass{ximera}",
+			"\\input{preamble}",
+			"\\usepackage{local,amsmath}",
+			"\\begin{document}",
+			"\\includegraphics{cat}",
+			"\\includegraphics[width=1in]{dog.png}",
+			"% \\includegraphics{hidden}",
+			"\\lstinputlisting{code/example.py}",
+			"\\end{document}",
+		}, "\n"),
+		"preamble.tex":     "\\graphicspath{{images/}{figures/}}\n",
+		"local.sty":        "",
+		"code/example.py":  "print(1)\n",
+		"figures/cat.png":  "",
+		"images/dog.png":   "",
+		"figures/dog.png":  "",
+		"hidden.png":       "",
+		"images/other.png": "",
+	})
+
+	dependencies, err := FileDependencies(filepath.Join(directory, "main.tex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, dependency := range dependencies {
+		relative, _ := filepath.Rel(directory, dependency.Filename)
+		found = append(found, fmt.Sprintf("%s %s %s@%d", dependency.Kind, filepath.ToSlash(relative), dependency.Command, dependency.Line))
+	}
+
+	// ximera.cls and amsmath.sty are not in the repository, and the
+	// first directory in \graphicspath holding an image wins
+	expected := []string{
+		"input preamble.tex input@2",
+		"package local.sty usepackage@3",
+		"listing code/example.py lstinputlisting@8",
+		"image figures/cat.png includegraphics@5",
+		"image images/dog.png includegraphics@6",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("FileDependencies found %q, expected %q", found, expected)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// assumeToolchainChanged treats documents which do not record the
+// toolchain which compiled them as having been compiled by another
+var assumeToolchainChanged = false
+
+var toolVersions = make(map[string]string)
+var toolVersionsMutex sync.Mutex
+
+// versionFlags are the options which make the programs run by
+// backends print their versions.  Programs without one, like htlatex,
+// which would take --version for a file to compile, are identified by
+// their toolFiles instead.
+var versionFlags = map[string]string{
+	"pdflatex": "--version",
+	"lualatex": "--version",
+	"make4ht":  "--version",
+	"sage":     "--version",
+}
+
+// toolFiles are the TeX files, found by kpsewhich, which decide what a
+// program does
+var toolFiles = map[string][]string{
+	"htlatex": {"tex4ht.sty", "tex4ht.4ht"},
+	"make4ht": {"tex4ht.sty", "tex4ht.4ht"},
+}
+
+// toolVersion reports the first line printed by `command flag`,
+// remembering the answer for the rest of the run
+func toolVersion(command string, flag string) string {
+	toolVersionsMutex.Lock()
+	defer toolVersionsMutex.Unlock()
+
+	if version, ok := toolVersions[command]; ok {
+		return version
+	}
+
+	version := "unknown"
+	cmdOut, err := exec.Command(command, flag).Output()
+	if err == nil {
+		version = strings.TrimSpace(strings.SplitN(string(cmdOut), "\n", 2)[0])
+	}
+
+	log.Debug(command + " is " + version)
+	toolVersions[command] = version
+	return version
+}
+
+// ximeraLatexFiles are the files of the ximeraLatex package which
+// shape every compiled document
+var ximeraLatexFiles = []string{"ximera.cls", "xourse.cls", "ximera.4ht", "xourse.4ht", "ximera.cfg"}
+
+var texFileHashes map[string]string
+var texFileHashesOnce sync.Once
+
+// installedTexFileHashes hashes whichever of the ximeraLatexFiles and
+// toolFiles kpsewhich finds, recording the rest as missing
+func installedTexFileHashes() map[string]string {
+	texFileHashesOnce.Do(func() {
+		texFileHashes = make(map[string]string)
+
+		var names []string
+		for _, name := range ximeraLatexFiles {
+			texFileHashes[name] = "missing"
+			names = append(names, name)
+		}
+		for _, files := range toolFiles {
+			for _, name := range files {
+				if _, ok := texFileHashes[name]; !ok {
+					texFileHashes[name] = "missing"
+					names = append(names, name)
+				}
+			}
+		}
+
+		// kpsewhich prints only the files it finds, so we match
+		// them up by name
+		cmdOut, err := exec.Command("kpsewhich", names...).Output()
+		if err != nil && len(cmdOut) == 0 {
+			return
+		}
+
+		for _, path := range strings.Split(string(cmdOut), "\n") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+
+			hash, err := HashObject(path)
+			if err == nil {
+				log.Debug("Found " + filepath.Base(path) + " at " + path)
+				texFileHashes[filepath.Base(path)] = hash
+			}
+		}
+	})
+
+	return texFileHashes
+}
+
+// toolchainComponentNames lists what, besides the repository, decides
+// the result of compiling with backend: the installed ximeraLatex
+// files, and the versions or support files of the programs it runs
+func toolchainComponentNames(backend Backend) []string {
+	names := append([]string{}, ximeraLatexFiles...)
+	seen := make(map[string]bool)
+
+	for _, step := range backend.Steps {
+		var components []string
+		if _, ok := versionFlags[step.Command]; ok {
+			components = append(components, step.Command)
+		}
+		components = append(components, toolFiles[step.Command]...)
+
+		for _, name := range components {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// toolchainComponent finds the current version of a program, or the
+// hash of a TeX file
+func toolchainComponent(name string) string {
+	if flag, ok := versionFlags[name]; ok {
+		return toolVersion(name, flag)
+	}
+	return installedTexFileHashes()[name]
+}
+
+// ToolchainComponents finds every component of the toolchain which
+// compiles with backend
+func ToolchainComponents(backend Backend) map[string]string {
+	components := make(map[string]string)
+	for _, name := range toolchainComponentNames(backend) {
+		components[name] = toolchainComponent(name)
+	}
+
+	return components
+}
+
+// ToolchainFingerprint summarizes the ToolchainComponents
+func ToolchainFingerprint(backend Backend) string {
+	components := ToolchainComponents(backend)
+
+	var names []string
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha1.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s %s\n", name, components[name])
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// abbreviateComponent shortens the hashes of files, but not versions
+func abbreviateComponent(value string) string {
+	if len(value) == 40 && strings.Trim(value, "0123456789abcdef") == "" {
+		return value[:7]
+	}
+	return value
+}
+
+// toolchainChanges describes how the current toolchain differs from
+// the recorded one; components which were not recorded are ignored,
+// so that a backend gaining a step does not look like an upgrade
+func toolchainChanges(recorded map[string]string, current map[string]string) []string {
+	var names []string
+	for name := range recorded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		now, ok := current[name]
+		if ok && now != recorded[name] {
+			changes = append(changes, fmt.Sprintf("%s changed (was %s, now %s)", name, abbreviateComponent(recorded[name]), abbreviateComponent(now)))
+		}
+	}
+
+	return changes
+}
+
+// ToolchainChanges describes how the toolchain which would compile
+// filename differs from the one recorded when it was last compiled;
+// backendName is the backend which was used then, if known
+func ToolchainChanges(filename string, backendName string, recorded map[string]string) []string {
+	name, backend, err := BackendFor(filename)
+	if err != nil {
+		return nil
+	}
+
+	if backendName != "" && backendName != name {
+		return []string{"the backend changed (was " + backendName + ", now " + name + ")"}
+	}
+
+	// only what was recorded is looked up, so that a file which
+	// records no toolchain never waits for, say, sage --version
+	current := make(map[string]string)
+	for _, name := range toolchainComponentNames(backend) {
+		if _, ok := recorded[name]; ok {
+			current[name] = toolchainComponent(name)
+		}
+	}
+
+	return toolchainChanges(recorded, current)
+}
+
+// RecordedToolchain reads the toolchain recorded in an .html file,
+// which is empty if the file records none
+func RecordedToolchain(htmlFilename string) (map[string]string, error) {
+	components := make(map[string]string)
+
+	f, err := os.Open(htmlFilename)
+	if err != nil {
+		return components, err
+	}
+	defer f.Close()
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		return components, err
+	}
+
+	readToolchainMetadata(doc, components)
+	return components, nil
+}
+
+// readToolchainMetadata collects the <meta name="toolchain"> tags,
+// whose content is a component followed by its hash or version
+func readToolchainMetadata(doc *goquery.Document, components map[string]string) {
+	doc.Find("meta[name=\"toolchain\"]").Each(func(i int, s *goquery.Selection) {
+		content, _ := s.Attr("content")
+		fields := strings.SplitN(content, " ", 2)
+		if len(fields) == 2 {
+			components[fields[0]] = fields[1]
+		}
+	})
+}
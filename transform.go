@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Transform is one link in the chain of transformations applied to
+// the HTML which a backend produces.  Without a Command, Name refers
+// to one of the built-in transforms; with a Command, the HTML is
+// piped through that program (run from the repository root), which
+// writes the transformed HTML to its standard output.
+type Transform struct {
+	Name      string   `json:"name"`
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments"`
+}
+
+// UnmarshalJSON permits a built-in transform to be named by a bare
+// string in .xake.json
+func (t *Transform) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		t.Name = name
+		return nil
+	}
+
+	type plainTransform Transform
+	return json.Unmarshal(data, (*plainTransform)(t))
+}
+
+// A transformContext describes the file whose HTML is being transformed
+type transformContext struct {
+	directory    string
+	filename     string
+	htmlFilename string
+	xourse       bool
+
+	// recorded lists the files TeX reported reading, if it did
+	recorded []string
+}
+
+type builtinTransform func(t transformContext, doc *goquery.Document) error
+
+var builtinTransforms = map[string]builtinTransform{
+	"remove-empty-paragraphs": removeEmptyParagraphs,
+	"dependencies":            addDependencyMetadata,
+	"xourse":                  transformXourseFiles,
+}
+
+var defaultTransforms = []Transform{
+	{Name: "remove-empty-paragraphs"},
+	{Name: "dependencies"},
+	{Name: "xourse"},
+}
+
+func transformChain() []Transform {
+	if configuration.Transforms != nil {
+		return configuration.Transforms
+	}
+	return defaultTransforms
+}
+
+func removeEmptyParagraphs(t transformContext, doc *goquery.Document) error {
+	log.Debug("Remove empty paragraphs of the form <p></p>")
+	doc.Find("p:empty").Each(func(i int, s *goquery.Selection) {
+		s.Remove()
+	})
+	return nil
+}
+
+// compiledDependencies lists everything which compiling filename reads,
+// including filename itself and whatever TeX recorded reading
+func compiledDependencies(filename string, recorded []string) ([]string, error) {
+	dependencies, err := AllDependencies(filename)
+	if err != nil {
+		return dependencies, err
+	}
+
+	// BADBAD: this does the wrong thing with xake compile
+	dependencies = append(dependencies, filename)
+
+	// Files read through macros are only found by the recorder
+	seen := make(map[string]bool)
+	for _, dependency := range dependencies {
+		seen[dependency] = true
+	}
+	for _, dependency := range recorded {
+		if !seen[dependency] {
+			seen[dependency] = true
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	return dependencies, nil
+}
+
+func addDependencyMetadata(t transformContext, doc *goquery.Document) error {
+	log.Debug("Add <meta> tags for all dependencies")
+	doc.Find("head").Each(func(_ int, s *goquery.Selection) {
+		dependencies, err := compiledDependencies(t.filename, t.recorded)
+		if err == nil {
+			for _, dependency := range dependencies {
+				relative, err := filepath.Rel(t.directory, dependency)
+
+				if err != nil {
+					continue
+				}
+
+				f, err := os.Open(dependency)
+				defer f.Close()
+
+				if err != nil {
+					continue
+				}
+
+				h := sha1.New()
+				if _, err := io.Copy(h, f); err == nil {
+					hash := fmt.Sprintf("%x", h.Sum(nil))
+					s.AppendHtml("<meta name=\"dependency\" content=\"" +
+						hash + " " +
+						relative + "\">")
+				}
+			}
+		}
+
+		// so that upgrading ximeraLatex or TeX is noticed, too
+		_, backend, err := BackendFor(t.filename)
+		if err == nil {
+			components := ToolchainComponents(backend)
+			var names []string
+			for name := range components {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				s.AppendHtml("<meta name=\"toolchain\" content=\"" +
+					html.EscapeString(name+" "+components[name]) + "\">")
+			}
+		}
+	})
+	return nil
+}
+
+func transformXourseFiles(t transformContext, doc *goquery.Document) error {
+	if t.xourse {
+		transformXourse(t.directory, t.filename, doc)
+	}
+	return nil
+}
+
+// filterHtml pipes the document through an external program
+func filterHtml(ctx context.Context, transform Transform, t transformContext, doc *goquery.Document) (*goquery.Document, error) {
+	html, err := doc.Html()
+	if err != nil {
+		return doc, err
+	}
+
+	timeout, err := timeoutForStep(BuildStep{})
+	if err != nil {
+		return doc, err
+	}
+
+	cmd := exec.Command(transform.Command, transform.Arguments...)
+	cmd.Dir = t.directory
+	cmd.Env = append(os.Environ(),
+		"XAKE_REPOSITORY="+t.directory,
+		"XAKE_FILENAME="+t.filename,
+		"XAKE_HTML_FILENAME="+t.htmlFilename)
+	if t.xourse {
+		cmd.Env = append(cmd.Env, "XAKE_XOURSE=1")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(html)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = runWithTimeout(ctx, cmd, transform.Name, timeout)
+	if _, ok := err.(*TimeoutError); ok || err == errInterrupted {
+		return doc, err
+	}
+	if err != nil {
+		return doc, fmt.Errorf("The %s transform failed: %s\n%s", transform.Name, err, stderr.String())
+	}
+
+	return goquery.NewDocumentFromReader(&stdout)
+}
+
+func applyTransform(ctx context.Context, transform Transform, t transformContext, doc *goquery.Document) (*goquery.Document, error) {
+	if transform.Command != "" {
+		return filterHtml(ctx, transform, t, doc)
+	}
+
+	builtin, ok := builtinTransforms[transform.Name]
+	if !ok {
+		return doc, fmt.Errorf("Unknown transform %s", transform.Name)
+	}
+
+	return doc, builtin(t, doc)
+}
+
+func isXourseDocument(htmlFilename string, doc *goquery.Document) bool {
+	xourseFile := false
+	doc.Find("meta[name=\"description\"]").Each(func(i int, s *goquery.Selection) {
+		content, exists := s.Attr("content")
+
+		if !exists {
+			log.Warn(htmlFilename + " is missing a content attribute on its meta[name=\"description\"]")
+		}
+
+		if content == "xourse" {
+			xourseFile = true
+		}
+	})
+
+	return xourseFile
+}
+
+// transformHtml runs the HTML produced for filename through the
+// repository's chain of transforms; recorded lists the files which
+// TeX read while compiling it
+func transformHtml(ctx context.Context, directory string, filename string, recorded []string) error {
+	htmlFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".html"
+
+	f, err := os.Open(htmlFilename)
+	defer f.Close()
+	if err != nil {
+		return err
+	}
+
+	doc, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		return err
+	}
+
+	t := transformContext{
+		directory:    directory,
+		filename:     filename,
+		htmlFilename: htmlFilename,
+		xourse:       isXourseDocument(htmlFilename, doc),
+		recorded:     recorded,
+	}
+
+	for _, transform := range transformChain() {
+		log.Debug("Applying the " + transform.Name + " transform to " + htmlFilename)
+		doc, err = applyTransform(ctx, transform, t, doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	html, err := doc.Html()
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(htmlFilename)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(htmlFilename, []byte(html), fileInfo.Mode())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
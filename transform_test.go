@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"github.com/PuerkitoBio/goquery"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterHtml(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the filters are shell scripts")
+	}
+
+	directory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := transformContext{directory: directory, filename: "intro.tex", htmlFilename: "intro.html"}
+
+	filter := func(script string) (*goquery.Document, error) {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader("<html><body><p>text</p></body></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filterHtml(context.Background(), Transform{Name: "filter", Command: "sh", Arguments: []string{"-c", script}}, tc, doc)
+	}
+
+	doc, err := filter("sed s/text/filtered/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Find("p").Text() != "filtered" {
+		t.Errorf("the filter did not change the document")
+	}
+
+	_, err = filter("echo broken >&2; exit 1")
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("a failing filter reported %v", err)
+	}
+
+	// a child which keeps the output open must not outlive the timeout
+	previous := stepTimeout
+	stepTimeout = 200 * time.Millisecond
+	defer func() { stepTimeout = previous }()
+
+	start := time.Now()
+	_, err = filter("sleep 30 & sleep 30")
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Errorf("a filter which hangs reported %v rather than timing out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the filter was only stopped after %s", elapsed)
+	}
+}
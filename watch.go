@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Editors often save a file in several steps, so we wait for things
+// to settle down before compiling anything
+const watchDebounce = 300 * time.Millisecond
+
+// watchDirectories adds directory and everything beneath it to the
+// watcher, skipping .git and other hidden directories, and those which
+// the ignore files of the repository at root ignore
+func watchDirectories(watcher *fsnotify.Watcher, root string, directory string) error {
+	ignore := NewIgnoreMatcher(root)
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if path != directory && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if ignored, _ := ignore.IgnoredDuringWalk(path, info); ignored {
+			return filepath.SkipDir
+		}
+
+		log.Debug("Watching " + path)
+		return watcher.Add(path)
+	})
+}
+
+// AffectedFiles lists the .tex documents among filenames which are
+// changed, or which depend (perhaps indirectly) on a changed file;
+// besides what scanning finds, a document depends on the files TeX
+// recorded it reading when it was last compiled in directory, which
+// include those read through macros
+func AffectedFiles(directory string, filenames []string, changed []string) []string {
+	dependents := make(map[string][]string)
+	for _, filename := range filenames {
+		dependencies, err := compiledDependencies(filename, RecordedBuildInputs(directory, filename))
+		if err != nil {
+			continue
+		}
+		for _, dependency := range dependencies {
+			dependents[dependency] = append(dependents[dependency], filename)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, filename := range filenames {
+		known[filename] = true
+	}
+
+	affected := make(map[string]bool)
+	var result []string
+	queue := append([]string{}, changed...)
+	for len(queue) > 0 {
+		filename := queue[0]
+		queue = queue[1:]
+
+		if affected[filename] {
+			continue
+		}
+		affected[filename] = true
+
+		if known[filename] {
+			result = append(result, filename)
+		}
+
+		queue = append(queue, dependents[filename]...)
+	}
+
+	return result
+}
+
+// updateTexFiles adds or removes a changed path from the list of .tex
+// documents, using the same criteria as TexFilesInRepository
+func updateTexFiles(directory string, filenames []string, path string) []string {
+	var result []string
+	for _, filename := range filenames {
+		if filename != path {
+			result = append(result, filename)
+		}
+	}
+
+	isTex, _ := IsTexDocument(path)
+	if !isTex {
+		return result
+	}
+
+	// the ignore files are reread, in case they were just edited
+	if ignored, _ := NewIgnoreMatcher(directory).Ignored(path); ignored {
+		return result
+	}
+
+	committed, _ := IsInRepository(directory, path)
+	if !committed {
+		rel, _ := filepath.Rel(directory, path)
+		log.Warn(rel + " is not committed to the repository and will be ignored.")
+		return result
+	}
+
+	return append(result, path)
+}
+
+// compileAffected recompiles whatever the changes require, printing a
+// line as each file finishes
+func compileAffected(ctx context.Context, workers int, directory string, filenames []string, changed []string, compiled func(string)) {
+	affected := AffectedFiles(directory, filenames, changed)
+	if len(affected) == 0 {
+		return
+	}
+
+	files, dependencies, err := NeedingCompilationAmong(affected)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if len(files) == 0 {
+		log.Debug("Everything affected is up to date")
+		return
+	}
+
+	green := color.New(color.FgGreen)
+	red := color.New(color.FgRed)
+
+	started := time.Now()
+	CompileInOrder(ctx, workers, directory, files, dependencies, true, func(report FileReport, err error) {
+		if report.Status == interruptedStatus {
+			return
+		}
+
+		filename := report.Filename
+		rel, _ := filepath.Rel(directory, filename)
+		elapsed := time.Since(started).Seconds()
+
+		if skipped, ok := err.(*SkippedError); ok {
+			red.Printf("✗ %s", rel)
+			fmt.Printf(" (%s)\n", skipped)
+		} else if err != nil {
+			red.Printf("✗ %s\n", rel)
+			DisplayCompileError(err)
+		} else {
+			green.Printf("✓ %s", rel)
+			fmt.Printf(" (%.1fs)\n", elapsed)
+			if compiled != nil {
+				compiled(filename)
+			}
+		}
+	})
+}
+
+// Watch compiles whatever needs compiling, and then keeps watching
+// the repository, recompiling files as they (or the files they
+// depend on) change, until interrupted.  If compiled is not nil, it
+// is called after each file is successfully compiled.
+func Watch(ctx context.Context, workers int, directory string, compiled func(string)) error {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = watchDirectories(watcher, directory, directory)
+	if err != nil {
+		return err
+	}
+
+	filenames, err := TexFilesInRepository(directory)
+	if err != nil {
+		return err
+	}
+
+	// compiling happens in the background, so that changes made
+	// meanwhile are noticed, and compiled in the next batch
+	done := make(chan bool)
+	compiling := true
+	go func(filenames []string) {
+		compileAffected(ctx, workers, directory, filenames, filenames, compiled)
+		done <- true
+	}(filenames)
+	log.Info("Watching " + directory + " for changes...")
+
+	changed := make(map[string]bool)
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if compiling {
+				<-done
+			}
+			return nil
+
+		case <-done:
+			compiling = false
+			if len(changed) > 0 {
+				timer.Reset(watchDebounce)
+			}
+
+		case err := <-watcher.Errors:
+			log.Warn(err)
+
+		case event := <-watcher.Events:
+			if event.Op == fsnotify.Chmod || isDeletable(event.Name) {
+				continue
+			}
+
+			// New directories need to be watched too
+			if event.Op&fsnotify.Create != 0 {
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					watchDirectories(watcher, directory, event.Name)
+					continue
+				}
+			}
+
+			log.Debug(event.String())
+			changed[event.Name] = true
+			timer.Reset(watchDebounce)
+
+		case <-timer.C:
+			if compiling {
+				// the batch starts when the current one finishes
+				continue
+			}
+
+			var paths []string
+			for path := range changed {
+				if filepath.Ext(path) == ".tex" {
+					filenames = updateTexFiles(directory, filenames, path)
+				}
+				paths = append(paths, path)
+			}
+			changed = make(map[string]bool)
+
+			compiling = true
+			go func(filenames []string, paths []string) {
+				compileAffected(ctx, workers, directory, filenames, paths, compiled)
+				done <- true
+			}(filenames, paths)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAffectedFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeFiles(t, directory, map[string]string{
+		"preamble.tex":     "\\usepackage{macros}\n",
+		"macros.sty":       "\\newcommand{\\data}[1]{\\input{data/#1}}\n",
+		"data/table.tex":   "1 & 2\n",
+		"chapter/one.tex":  "\\input{../preamble}\n",
+		"chapter/two.tex":  "\\data{table}\n",
+		"chapter/lone.tex": "alone\n",
+	})
+
+	path := func(name string) string {
+		return filepath.Join(directory, filepath.FromSlash(name))
+	}
+	documents := []string{path("chapter/one.tex"), path("chapter/two.tex"), path("chapter/lone.tex")}
+
+	// TeX reported that two.tex read the table through \data
+	err = RecordBuildState(directory, path("chapter/two.tex"), TargetState{
+		Outcome: compiledOutcome,
+		Inputs: map[string]InputState{
+			"chapter/two.tex": {Hash: "1"},
+			"data/table.tex":  {Hash: "2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		changed  string
+		affected []string
+	}{
+		{"macros.sty", []string{"chapter/one.tex"}},
+		{"data/table.tex", []string{"chapter/two.tex"}},
+		{"chapter/lone.tex", []string{"chapter/lone.tex"}},
+		{"unrelated.tex", nil},
+	}
+
+	for _, test := range tests {
+		var affected []string
+		for _, filename := range AffectedFiles(directory, documents, []string{path(test.changed)}) {
+			relative, _ := filepath.Rel(directory, filename)
+			affected = append(affected, filepath.ToSlash(relative))
+		}
+		sort.Strings(affected)
+
+		if !reflect.DeepEqual(affected, test.affected) {
+			t.Errorf("changing %s affected %q, expected %q", test.changed, affected, test.affected)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Commits are compiled in worktrees kept beside the build state, so
+// that git ignores them and a second bake of the same commit can pick
+// up where the first left off
+const worktreesDirectory = "worktrees"
+
+// runGit runs git in directory, with extra environment variables, and
+// returns what it printed
+func runGit(directory string, environment []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = directory
+	cmd.Env = append(os.Environ(), environment...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	log.Debug("Running git " + strings.Join(args, " "))
+	output, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return "", fmt.Errorf("git %s failed: %s", strings.Join(args, " "), message)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// stagedCommit records the index as a commit whose parent is HEAD,
+// without moving HEAD or any branch; it is dated like HEAD, so the
+// same index always produces the same commit
+func stagedCommit(directory string) (string, error) {
+	tree, err := runGit(directory, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+
+	head, err := runGit(directory, nil, "rev-parse", "--verify", "HEAD^{commit}")
+	if err != nil {
+		return "", err
+	}
+
+	date, err := runGit(directory, nil, "log", "-1", "--format=%ct", head)
+	if err != nil {
+		return "", err
+	}
+
+	environment := []string{
+		"GIT_AUTHOR_NAME=xake",
+		"GIT_AUTHOR_EMAIL=xake@localhost",
+		"GIT_AUTHOR_DATE=" + date + " +0000",
+		"GIT_COMMITTER_NAME=xake",
+		"GIT_COMMITTER_EMAIL=xake@localhost",
+		"GIT_COMMITTER_DATE=" + date + " +0000",
+	}
+
+	return runGit(directory, environment, "commit-tree", tree, "-p", head, "-m", "Staged changes compiled by xake")
+}
+
+// unusableWorktree explains why the worktree cannot be reused for
+// commit, or returns "" if it can; the files a bake left behind are
+// untracked, so only changes to tracked files count against it
+func unusableWorktree(worktree string, commit string) string {
+	// a directory which git no longer knows as a worktree would
+	// otherwise be taken for part of the repository around it
+	toplevel, err := runGit(worktree, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err.Error()
+	}
+	if !sameDirectory(toplevel, worktree) {
+		return "it is not a worktree"
+	}
+
+	head, err := runGit(worktree, nil, "rev-parse", "--verify", "HEAD^{commit}")
+	if err != nil {
+		return err.Error()
+	}
+	if head != commit {
+		return "it has " + head + " checked out"
+	}
+
+	status, err := runGit(worktree, nil, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return err.Error()
+	}
+	if status != "" {
+		return "its files were changed"
+	}
+
+	return ""
+}
+
+// sameDirectory reports whether two paths name the same directory
+func sameDirectory(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+// removeWorktree removes a worktree, or whatever is left of one, so
+// that it can be added afresh
+func removeWorktree(toplevel string, worktree string) error {
+	_, err := runGit(toplevel, nil, "worktree", "remove", "--force", worktree)
+	if err != nil {
+		log.Debug("Removing the directory instead, since " + err.Error())
+		err = os.RemoveAll(worktree)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = runGit(toplevel, nil, "worktree", "prune")
+	return err
+}
+
+// MaterializeWorktree checks out the commit named by rev, or a commit
+// of the index if staged, into a worktree of the repository containing
+// directory, leaving the author's own working copy alone
+func MaterializeWorktree(directory string, rev string, staged bool) (worktree string, commit string, err error) {
+	toplevel, err := runGit(directory, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", "", err
+	}
+
+	if staged {
+		commit, err = stagedCommit(toplevel)
+	} else {
+		commit, err = runGit(toplevel, nil, "rev-parse", "--verify", rev+"^{commit}")
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	err = ensureStateDirectory(toplevel)
+	if err != nil {
+		return "", "", err
+	}
+
+	worktree = filepath.Join(toplevel, stateDirectory, worktreesDirectory, commit)
+	if exists(worktree) {
+		reason := unusableWorktree(worktree, commit)
+		if reason == "" {
+			log.Debug("Reusing the worktree " + worktree)
+		} else {
+			log.Warn("Recreating the worktree " + worktree + " because " + reason)
+			err = removeWorktree(toplevel, worktree)
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	if !exists(worktree) {
+		_, err = runGit(toplevel, nil, "worktree", "add", "--detach", worktree, commit)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	// work in the same part of the repository as we were asked to
+	relative, err := filepath.Rel(toplevel, directory)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		relative = "."
+	}
+
+	return filepath.Join(worktree, relative), commit, nil
+}
+
+// EnterWorktree materializes a commit, or the index, and makes its
+// worktree the repository which xake works on
+func EnterWorktree(rev string, staged bool) (worktree string, commit string, err error) {
+	worktree, commit, err = MaterializeWorktree(repository, rev, staged)
+	if err != nil {
+		return "", "", err
+	}
+
+	if staged {
+		fmt.Printf("Compiling the staged changes, as commit %s, in %s\n", commit[:7], displayName(worktree))
+	} else {
+		fmt.Printf("Compiling %s, commit %s, in %s\n", rev, commit[:7], displayName(worktree))
+	}
+
+	err = os.Chdir(worktree)
+	if err != nil {
+		return "", "", err
+	}
+	repository = worktree
+
+	// the worktree's own .xake.json governs how it is built
+	configuration = RepositoryConfiguration{}
+	err = LoadConfiguration(worktree)
+	return worktree, commit, err
+}
+
+// DisplayWorktreeInstructions explains how to publish what was compiled
+// in a worktree, and how to remove it afterwards
+func DisplayWorktreeInstructions(worktree string, commit string) {
+	fmt.Printf("\nThe compiled files for commit %s are in %s\n", commit[:7], worktree)
+	fmt.Printf("To publish exactly that commit, run\n\n")
+	fmt.Printf("    cd %s && xake frost && xake serve\n\n", worktree)
+	fmt.Printf("and when you no longer need the worktree,\n\n")
+	fmt.Printf("    git worktree remove --force %s\n", worktree)
+}
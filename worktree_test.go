@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaterializeWorktreeChecksWhatItReuses(t *testing.T) {
+	directory, err := ioutil.TempDir("", "xake-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	author := []string{
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@localhost",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@localhost",
+	}
+	git := func(args ...string) string {
+		output, err := runGit(directory, author, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	git("init", "-q")
+	writeFiles(t, directory, map[string]string{"intro.tex": "first\n"})
+	git("add", "intro.tex")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+	writeFiles(t, directory, map[string]string{"intro.tex": "second\n"})
+	git("commit", "-q", "-a", "-m", "second")
+	second := git("rev-parse", "HEAD")
+
+	materialize := func() string {
+		worktree, commit, err := MaterializeWorktree(directory, first, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commit != first {
+			t.Fatalf("MaterializeWorktree checked out %s rather than %s", commit, first)
+		}
+		return worktree
+	}
+	contents := func(filename string) string {
+		b, _ := ioutil.ReadFile(filename)
+		return string(b)
+	}
+
+	worktree := materialize()
+	source := filepath.Join(worktree, "intro.tex")
+	output := filepath.Join(worktree, "intro.html")
+
+	// what a previous bake compiled is kept
+	writeFiles(t, worktree, map[string]string{"intro.html": "compiled\n"})
+	materialize()
+	if contents(output) != "compiled\n" {
+		t.Errorf("a clean worktree was not reused")
+	}
+
+	// but not an edited source
+	writeFiles(t, worktree, map[string]string{"intro.tex": "edited\n"})
+	materialize()
+	if contents(source) != "first\n" {
+		t.Errorf("a worktree with edited sources was reused")
+	}
+
+	// nor another commit
+	if _, err := runGit(worktree, nil, "checkout", "-q", "--detach", second); err != nil {
+		t.Fatal(err)
+	}
+	materialize()
+	if contents(source) != "first\n" {
+		t.Errorf("a worktree with another commit checked out was reused")
+	}
+
+	// nor a directory which is no longer a worktree at all
+	os.Remove(filepath.Join(worktree, ".git"))
+	materialize()
+	if head, err := runGit(worktree, nil, "rev-parse", "--show-toplevel"); err != nil || !sameDirectory(head, worktree) {
+		t.Errorf("a directory which was not a worktree was reused")
+	}
+}